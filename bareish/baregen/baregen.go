@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"go/format"
 	"log"
@@ -13,13 +14,13 @@ import (
 )
 
 const templateString = `
-package main
+package {{ .package }}
 
 // Code generated by go-bare/cmd/gen, DO NOT EDIT.
 
 import (
-{{- if .schema.NeedErrors }}
-	"errors"
+{{- if .schema.NeedFmt }}
+	"fmt"
 {{- end }}
 	"lotor/bareish"
 )
@@ -78,7 +79,7 @@ const (
 			return "{{ .Name }}"
 		{{- end -}}
 		}
-		panic(errors.New("Invalid {{.Name}} value"))
+		return fmt.Sprintf("{{ .Name }}(%d)", {{ primitiveType .Kind }}(t))
 	}
 {{end}}
 
@@ -188,6 +189,7 @@ func main() {
 	data := make(map[string]interface{})
 
 	data["schema"] = types
+	data["package"] = cfg.Package
 
 	err = tmpl.Execute(out, data)
 	if err != nil {
@@ -208,8 +210,9 @@ func main() {
 }
 
 type Config struct {
-	In  string
-	Out string
+	Package string
+	In      string
+	Out     string
 }
 
 func parseArgs() *Config {
@@ -217,22 +220,25 @@ func parseArgs() *Config {
 
 	log.SetFlags(0)
 
-	args := os.Args
-	if len(args) != 3 {
-		log.Fatal("Usage: baregen <input.bare> <output.go>")
+	flag.StringVar(&cfg.Package, "p", "main", "package name of the generated code")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) != 2 {
+		log.Fatal("Usage: baregen [-p package] <input.bare> <output.go>")
 	}
 
-	cfg.In = args[1]
-	cfg.Out = args[2]
+	cfg.In = args[0]
+	cfg.Out = args[1]
 
 	return cfg
 }
 
 type Types struct {
-	UserTypes  []*schema.UserDefinedType
-	Enums      []*schema.UserDefinedEnum
-	Unions     []*schema.UserDefinedType
-	NeedErrors bool
+	UserTypes []*schema.UserDefinedType
+	Enums     []*schema.UserDefinedEnum
+	Unions    []*schema.UserDefinedType
+	NeedFmt   bool
 }
 
 func parseSchema(path string) Types {
@@ -265,7 +271,7 @@ func parseSchema(path string) Types {
 	}
 
 	if len(types.Enums) > 0 {
-		types.NeedErrors = true
+		types.NeedFmt = true
 	}
 
 	return types
@@ -94,6 +94,9 @@ func encoderFunc(t reflect.Type) encodeFunc {
 	case reflect.Array:
 		return encodeArray(t)
 	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return encodeData
+		}
 		return encodeSlice(t)
 	case reflect.Map:
 		return encodeMap(t)
@@ -185,6 +188,10 @@ func encodeSlice(t reflect.Type) encodeFunc {
 	}
 }
 
+func encodeData(w *Writer, v reflect.Value) error {
+	return w.WriteData(v.Bytes())
+}
+
 func encodeMap(t reflect.Type) encodeFunc {
 	keyType := t.Key()
 	keyf := getEncoder(keyType)
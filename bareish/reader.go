@@ -13,6 +13,13 @@ type byteReader interface {
 	io.ByteReader
 }
 
+// Implemented by readers which know how many bytes they have left, such as
+// bytes.Reader, so that lengths read from the message can be checked against
+// them before allocating.
+type lenReader interface {
+	Len() int
+}
+
 // A Reader for BARE primitive types.
 type Reader struct {
 	base    byteReader
@@ -172,6 +179,9 @@ func (r *Reader) ReadData() ([]byte, error) {
 	if l >= maxUnmarshalBytes {
 		return nil, ErrLimitExceeded
 	}
+	if lr, ok := r.base.(lenReader); ok && l > uint64(lr.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
 	buf := make([]byte, l)
 	var amt uint64 = 0
 	for amt < l {
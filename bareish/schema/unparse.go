@@ -84,7 +84,7 @@ func SchemaForType(t reflect.Type) (string, error) {
 	case reflect.Struct:
 		return schemaForStruct(t)
 	default:
-		return "", &bareish.UnsupportedTypeError{t}
+		return "", &bareish.UnsupportedTypeError{Type: t}
 	}
 }
 
@@ -77,6 +77,9 @@ func decoderFunc(t reflect.Type) decodeFunc {
 	case reflect.Array:
 		return decodeArray(t)
 	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return decodeData
+		}
 		return decodeSlice(t)
 	case reflect.Map:
 		return decodeMap(t)
@@ -182,6 +185,17 @@ func decodeSlice(t reflect.Type) decodeFunc {
 	}
 }
 
+// Byte slices are BARE data, which is limited by MaxUnmarshalBytes rather
+// than MaxArrayLength and read in one go rather than byte by byte.
+func decodeData(r *Reader, v reflect.Value) error {
+	buf, err := r.ReadData()
+	if err != nil {
+		return err
+	}
+	v.SetBytes(buf)
+	return nil
+}
+
 func decodeMap(t reflect.Type) decodeFunc {
 	keyType := t.Key()
 	keyf := getDecoder(keyType)
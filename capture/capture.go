@@ -0,0 +1,233 @@
+// Package capture records the frames sent and received on a lotor connection
+// into a capture file, and reads them back. The file format is described by
+// schema.bare, from which the Header and Record types are generated.
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"lotor/frame"
+	"lotor/proto"
+)
+
+// The magic string and format version written in every Header.
+const (
+	Magic   = "lotor-capture"
+	Version = 1
+)
+
+// The largest frame of a capture file. Each record holds a protocol frame
+// body and a few bytes of metadata, so this also bounds the frames which can
+// be captured.
+const MaxRecordSize uint64 = 32 * 1024 * 1024 /* 32 MiB */
+
+// A Writer records frames into a capture file. It is safe for concurrent use.
+type Writer struct {
+	mu    sync.Mutex
+	w     *frame.Writer
+	c     io.Closer
+	start time.Time
+	err   error
+}
+
+// Starts a capture written to w, recorded from the point of view of role.
+func NewWriter(w io.Writer, role Role) (*Writer, error) {
+	cw := &Writer{
+		w:     frame.NewWriter(w, MaxRecordSize),
+		start: time.Now(),
+	}
+	if c, ok := w.(io.Closer); ok {
+		cw.c = c
+	}
+
+	header := &Header{
+		Magic:   Magic,
+		Version: Version,
+		Role:    role,
+		Start:   cw.start.UnixNano(),
+	}
+	data, err := header.Encode()
+	if err != nil {
+		return nil, err
+	}
+	err = cw.w.WriteFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Creates the capture file at path. Since captures may hold credentials, the
+// file is only readable by its owner.
+func Create(path string, role Role) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f, role)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Records a frame body sent or received at the current time. After the first
+// error, nothing more is recorded and the error is returned again.
+func (w *Writer) Record(dir Direction, body []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+	rec := &Record{
+		Direction: dir,
+		Time:      int64(time.Since(w.start)),
+		Body:      body,
+	}
+	data, err := rec.Encode()
+	if err == nil {
+		err = w.w.WriteFrame(data)
+	}
+	w.err = err
+	return err
+}
+
+// Closes the underlying writer if it is an io.Closer. Returns the first
+// error encountered while recording, if any.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.err
+	if w.err == nil {
+		w.err = errors.New("Capture is closed")
+	}
+	if w.c != nil {
+		cerr := w.c.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Returns a ReadFramer which records every frame read from r as received.
+// Recording errors do not affect reads; they are reported by Close. Passwords
+// and tokens are blanked out in the capture, as with Writer.
+func (w *Writer) Reader(r frame.ReadFramer) frame.ReadFramer {
+	return &reader{r, w}
+}
+
+// Returns a WriteFramer which records every frame written to fw as sent.
+// Recording errors do not affect writes; they are reported by Close. Passwords
+// and tokens are blanked out in the capture, so that it can be shared and
+// replaying it does not log in with them.
+func (w *Writer) Writer(fw frame.WriteFramer) frame.WriteFramer {
+	return &writer{fw, w}
+}
+
+type reader struct {
+	r frame.ReadFramer
+	w *Writer
+}
+
+func (r *reader) ReadFrame() ([]byte, error) {
+	body, err := r.r.ReadFrame()
+	if err == nil {
+		r.w.Record(RECEIVED, redact(body))
+	}
+	return body, err
+}
+
+type writer struct {
+	fw frame.WriteFramer
+	w  *Writer
+}
+
+func (w *writer) WriteFrame(body []byte) error {
+	err := w.fw.WriteFrame(body)
+	if err == nil {
+		w.w.Record(SENT, redact(body))
+	}
+	return err
+}
+
+// Returns body with the credentials of an authentication message blanked
+// out, or body itself if it holds no credentials.
+func redact(body []byte) []byte {
+	var msg proto.Msg
+	if proto.DecodeMsg(body, &msg) != nil {
+		return body
+	}
+	switch m := msg.(type) {
+	case *proto.MsgAuthPlain:
+		m.Password = ""
+	case *proto.MsgAuthToken:
+		m.Token = ""
+	default:
+		return body
+	}
+	redacted, err := proto.EncodeMsg(&msg)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+// Returned by NewReader when its input is not a capture file it can read.
+type FormatError struct {
+	Message string
+}
+
+func (e *FormatError) Error() string {
+	return "Bad capture file: " + e.Message
+}
+
+// A Reader reads the records of a capture file.
+type Reader struct {
+	Header Header
+
+	r *frame.Reader
+}
+
+// Reads the header of the capture in r.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{r: frame.NewReader(r, MaxRecordSize)}
+	data, err := cr.r.ReadFrame()
+	if err == io.EOF {
+		return nil, &FormatError{"empty file"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = cr.Header.Decode(data)
+	if err != nil || cr.Header.Magic != Magic {
+		return nil, &FormatError{"not a capture file"}
+	}
+	if cr.Header.Version != Version {
+		return nil, &FormatError{fmt.Sprintf("unsupported version %d", cr.Header.Version)}
+	}
+	return cr, nil
+}
+
+// Returns the next record, or io.EOF after the last one.
+func (r *Reader) Next() (*Record, error) {
+	data, err := r.r.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &Record{}
+	err = rec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
@@ -0,0 +1,691 @@
+// Package client implements a client for the lotor protocol.
+//
+// A Conn sends commands to the server with Join, Send and Part, and receives
+// everything the server sends back with Recv. Commands do not wait for the
+// server's response: confirmations (MsgJoined, MsgParted, MsgAck) and
+// rejections (MsgError) arrive through Recv in the order the commands were
+// sent. Pings from the server are answered automatically, even while Recv is
+// not being called, and Ping measures the round-trip time to the server.
+// Deliveries which arrive while too many are waiting for Recv are dropped and
+// recovered from the history later, if the server offers it; see
+// WithRecvBuffer.
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lotor/faultnet"
+	"lotor/frame"
+	"lotor/proto"
+)
+
+// How long Dial and NewConn wait for the server's MsgHello.
+const handshakeTimeout = 10 * time.Second
+
+// A Conn is a connection to a lotor server. It is safe for concurrent use.
+type Conn struct {
+	nc net.Conn
+	r  frame.ReadFramer
+
+	wmu sync.Mutex
+	w   frame.WriteFramer
+
+	version  uint
+	caps     []string
+	identity string
+
+	// Messages read but not yet returned by Recv. The read loop never
+	// waits for Recv, so that pings are answered however slowly the
+	// messages are consumed. Instead, new deliveries are dropped while
+	// maxIn of them are waiting, and recovered from the history later if
+	// the server offers it. Other messages are never dropped.
+	inMu         sync.Mutex
+	in           []proto.Msg
+	inDeliveries int
+	maxIn        int
+	// Receives a value whenever a message is added to in.
+	inWake chan struct{}
+	// The error that ended the read loop, set before ended is closed.
+	err   error
+	ended chan struct{}
+
+	done chan struct{}
+
+	// Sequence numbers seen on each target.
+	seqMu sync.Mutex
+	seqs  map[string]*targetSeqs
+	// Set when a history request was put off because too many deliveries
+	// were waiting for Recv. Recv sends it once there is room.
+	recoveryDeferred bool
+
+	// Outstanding pings sent by Ping, by nonce.
+	pingMu    sync.Mutex
+	pingNonce uint64
+	pings     map[uint64]chan struct{}
+	// Round-trip time measured by the last successful Ping, in nanoseconds.
+	rtt int64 // atomic
+
+	closeOnce sync.Once
+}
+
+// Connects to the lotor server at addr over TCP, or TLS if configured with
+// WithTLS, performs the handshake and authenticates if credentials were
+// given.
+func Dial(addr string, opts ...Option) (*Conn, error) {
+	o := newOptions(opts)
+
+	var (
+		nc  net.Conn
+		err error
+	)
+	if o.tls != nil {
+		nc, err = tls.Dial("tcp", addr, o.tls)
+	} else {
+		nc, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o.faults != nil {
+		nc = faultnet.Wrap(nc, *o.faults)
+	}
+	return newConn(nc, o)
+}
+
+// Performs the handshake and authentication over nc and returns a Conn
+// speaking the lotor protocol over it. The Conn takes ownership of nc, which
+// is closed if the handshake fails.
+func NewConn(nc net.Conn, opts ...Option) (*Conn, error) {
+	return newConn(nc, newOptions(opts))
+}
+
+func newConn(nc net.Conn, o *options) (*Conn, error) {
+	c := &Conn{
+		nc:     nc,
+		r:      frame.NewReader(nc, frame.DefaultMaxSize),
+		w:      frame.NewWriter(nc, frame.DefaultMaxSize),
+		maxIn:  o.recvBuffer,
+		inWake: make(chan struct{}, 1),
+		ended:  make(chan struct{}),
+		done:   make(chan struct{}),
+		seqs:   make(map[string]*targetSeqs),
+		pings:  make(map[uint64]chan struct{}),
+	}
+	if o.capture != nil {
+		c.r = o.capture.Reader(c.r)
+		c.w = o.capture.Writer(c.w)
+	}
+
+	nc.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := c.handshake(o)
+	if _, ok := o.auth.(*proto.MsgAuthExternal); ok && err == nil && !c.HasCapability(proto.CapExternalAuth) {
+		err = ErrNoExternalAuth
+	}
+	if err == nil && o.auth != nil {
+		err = c.authenticate(o.auth, o.key)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *Conn) handshake(o *options) error {
+	err := c.send(&proto.MsgHello{
+		Version:      proto.Version,
+		Capabilities: o.capabilities,
+	})
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.readMsg()
+	if err != nil {
+		return err
+	}
+	switch msg := msg.(type) {
+	case *proto.MsgHello:
+		if msg.Version < proto.MinVersion || msg.Version > proto.Version {
+			return fmt.Errorf("Server chose unsupported protocol version %d", msg.Version)
+		}
+		c.version = msg.Version
+		c.caps = msg.Capabilities
+		return nil
+	case *proto.MsgError:
+		return &Error{Code: msg.Code, Message: msg.Message}
+	}
+	return &UnexpectedMessageError{msg}
+}
+
+func (c *Conn) authenticate(auth proto.Msg, key ed25519.PrivateKey) error {
+	err := c.send(auth)
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.readMsg()
+	if err != nil {
+		return err
+	}
+	if challenge, ok := msg.(*proto.MsgAuthChallenge); ok && key != nil {
+		err = c.send(&proto.MsgAuthSignature{
+			Signature: ed25519.Sign(key, proto.ChallengeMessage(challenge.Nonce)),
+		})
+		if err != nil {
+			return err
+		}
+
+		msg, err = c.readMsg()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch msg := msg.(type) {
+	case *proto.MsgAuthOk:
+		c.identity = msg.Identity
+		return nil
+	case *proto.MsgError:
+		return &Error{Code: msg.Code, Message: msg.Message}
+	}
+	return &UnexpectedMessageError{msg}
+}
+
+// Reads and decodes a single message. Pings from the server are answered
+// here rather than returned.
+func (c *Conn) readMsg() (proto.Msg, error) {
+	for {
+		data, err := c.r.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		var msg proto.Msg
+		err = proto.DecodeMsg(data, &msg)
+		if err != nil {
+			return nil, err
+		}
+
+		if ping, ok := msg.(*proto.MsgPing); ok {
+			err = c.send(&proto.MsgPong{Nonce: ping.Nonce})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// Returns the protocol version negotiated with the server.
+func (c *Conn) Version() uint {
+	return c.version
+}
+
+// Returns the identity the server authenticated this Conn as, or "" if no
+// credentials were given.
+func (c *Conn) Identity() string {
+	return c.identity
+}
+
+// Returns the capabilities negotiated with the server.
+func (c *Conn) Capabilities() []string {
+	return c.caps
+}
+
+// Reports whether the server agreed to capability cap.
+func (c *Conn) HasCapability(cap string) bool {
+	for _, have := range c.caps {
+		if have == cap {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Conn) readLoop() {
+	for {
+		msg, err := c.readMsg()
+		if err != nil {
+			c.end(err)
+			return
+		}
+		if pong, ok := msg.(*proto.MsgPong); ok {
+			c.pong(pong)
+			continue
+		}
+		if !c.track(msg) {
+			continue
+		}
+
+		c.inMu.Lock()
+		c.in = append(c.in, msg)
+		if _, ok := msg.(*proto.MsgDeliver); ok {
+			c.inDeliveries++
+		}
+		c.inMu.Unlock()
+		c.wake()
+	}
+}
+
+// Ends the read loop with err, which Recv returns once the messages read
+// before it have been returned. The end of a connection which was not closed
+// with Close is an error even if the server closed it cleanly, since the
+// server only does so when it gives up on the client.
+func (c *Conn) end(err error) {
+	select {
+	case <-c.done:
+		err = net.ErrClosed
+	default:
+		if err == io.EOF {
+			err = ErrServerClosed
+		}
+	}
+
+	c.inMu.Lock()
+	c.err = err
+	c.inMu.Unlock()
+	close(c.ended)
+}
+
+// Reports whether there is room for another delivery to wait for Recv.
+func (c *Conn) room() bool {
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+	return c.inDeliveries < c.maxIn
+}
+
+// Wakes a Recv waiting for a message.
+func (c *Conn) wake() {
+	select {
+	case c.inWake <- struct{}{}:
+	default:
+	}
+}
+
+// What the Conn knows about the sequence numbers of a target.
+type targetSeqs struct {
+	// The last sequence number seen.
+	last uint
+	// Ranges of sequence numbers which were skipped and have not been
+	// recovered yet, oldest first.
+	gaps []gap
+	// Whether a history request for the first gap is outstanding, and
+	// whether any of the gap has been replayed since it was sent.
+	pending  bool
+	progress bool
+	// Set while waiting to send a request again after the server rate
+	// limited it, and how long the next wait will be.
+	retry      *time.Timer
+	retryDelay time.Duration
+}
+
+// A range of sequence numbers, from first to last inclusive.
+type gap struct {
+	first, last uint
+}
+
+// How long the Conn waits before asking again for a gap after the server
+// rate limited its request, at first and at most. The wait doubles with each
+// rate limited request in a row.
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// Tracks the sequence numbers delivered on each target. When a message skips
+// ahead of the last one seen, the missing range is requested from the history
+// if the server offers it; the recovered messages then arrive through Recv
+// after the one that revealed the gap. Messages with a sequence number at or
+// below the last one seen, such as replayed ones, do not move the tracking.
+// Errors answering these requests are not returned by Recv.
+// User targets have no history, so gaps on them are not recovered. Tracking
+// of a target starts over once it is parted; joining a target again while
+// still a member, which the server also confirms, does not reset it.
+//
+// The server replays a limited number of messages per request, so a gap is
+// requested again from where the replay stopped until it is closed. Only one
+// request per target is outstanding at a time, and a request which is rate
+// limited is sent again after a while. A gap is given up on when a replay
+// brings none of it, as happens once the history has dropped it.
+//
+// New deliveries which arrive while Recv has too many waiting are dropped,
+// and become part of a gap like those the server dropped. Gaps are not
+// requested while there is no room, so that a replay never
+// piles up behind an application which is not calling Recv. Replayed messages
+// are always kept; each replay is bounded by the server. Returns false if msg
+// is to be dropped.
+func (c *Conn) track(msg proto.Msg) bool {
+	c.seqMu.Lock()
+	keep, req := c.trackLocked(msg)
+	c.seqMu.Unlock()
+
+	if req != nil {
+		// A failure to send means the connection is going away, which
+		// the read loop notices on its own.
+		c.send(req)
+	}
+	return keep
+}
+
+// Updates the tracking for msg. Returns whether to keep msg, and the history
+// request to send, if any. Must be called with c.seqMu held.
+func (c *Conn) trackLocked(msg proto.Msg) (bool, *proto.MsgHistory) {
+	switch msg := msg.(type) {
+	case *proto.MsgParted:
+		c.forget(msg.Target)
+	case *proto.MsgDeliver:
+		ts, ok := c.seqs[string(msg.Target)]
+		if ok && msg.Seq <= ts.last {
+			ts.replayed(msg.Seq)
+			return true, nil
+		}
+		keep := c.room()
+		if !ok {
+			if keep || msg.Seq == 0 {
+				c.seqs[string(msg.Target)] = &targetSeqs{last: msg.Seq}
+				return keep, nil
+			}
+			// Start tracking just before it, so that dropping it
+			// makes a gap.
+			ts = &targetSeqs{last: msg.Seq - 1}
+			c.seqs[string(msg.Target)] = ts
+		}
+
+		first, last := ts.last+1, msg.Seq-1
+		if !keep {
+			last = msg.Seq
+		}
+		_, user := proto.ParseUserTarget(msg.Target)
+		if first <= last && !user && c.HasCapability(proto.CapHistory) {
+			ts.addGap(first, last)
+		}
+		ts.last = msg.Seq
+		return keep, c.request(msg.Target, ts)
+	case *proto.MsgHistoryEnd:
+		ts, ok := c.seqs[string(msg.Target)]
+		if !ok || !ts.pending {
+			return true, nil
+		}
+		ts.pending = false
+		ts.retryDelay = 0
+		if len(ts.gaps) > 0 && !ts.progress {
+			ts.gaps = ts.gaps[1:]
+		}
+		return true, c.request(msg.Target, ts)
+	case *proto.MsgError:
+		if msg.Target == nil {
+			return true, nil
+		}
+		target := *msg.Target
+		ts, ok := c.seqs[string(target)]
+		if !ok || !ts.pending {
+			return true, nil
+		}
+		// The error answers a request the application did not make, so
+		// it does not reach Recv.
+		ts.pending = false
+		if msg.Code == proto.ERR_RATE_LIMITED {
+			if ts.retryDelay == 0 {
+				ts.retryDelay = minRetryDelay
+			}
+			ts.retry = time.AfterFunc(ts.retryDelay, func() {
+				c.retryGap(target, ts)
+			})
+			ts.retryDelay *= 2
+			if ts.retryDelay > maxRetryDelay {
+				ts.retryDelay = maxRetryDelay
+			}
+		} else {
+			// Asking again would not help.
+			ts.gaps = nil
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// Stops tracking target. Must be called with c.seqMu held.
+func (c *Conn) forget(target []byte) {
+	if ts, ok := c.seqs[string(target)]; ok && ts.retry != nil {
+		ts.retry.Stop()
+	}
+	delete(c.seqs, string(target))
+}
+
+// Sends the history request of target again once its wait is over.
+func (c *Conn) retryGap(target []byte, ts *targetSeqs) {
+	c.seqMu.Lock()
+	var req *proto.MsgHistory
+	if c.seqs[string(target)] == ts {
+		ts.retry = nil
+		req = c.request(target, ts)
+	}
+	c.seqMu.Unlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if req != nil {
+		c.send(req)
+	}
+}
+
+// Adds the range from first to last to the gaps, which it follows.
+func (ts *targetSeqs) addGap(first, last uint) {
+	if n := len(ts.gaps); n > 0 && ts.gaps[n-1].last+1 == first {
+		ts.gaps[n-1].last = last
+		return
+	}
+	ts.gaps = append(ts.gaps, gap{first, last})
+}
+
+// Notes that seq has been replayed.
+func (ts *targetSeqs) replayed(seq uint) {
+	if len(ts.gaps) == 0 {
+		return
+	}
+	g := &ts.gaps[0]
+	if seq < g.first || seq > g.last {
+		return
+	}
+	ts.progress = true
+	g.first = seq + 1
+	if g.first > g.last {
+		ts.gaps = ts.gaps[1:]
+	}
+}
+
+// Sends the history requests which were put off for lack of room, once Recv
+// has made some.
+func (c *Conn) resumeRecovery() {
+	var reqs []*proto.MsgHistory
+	c.seqMu.Lock()
+	if c.recoveryDeferred {
+		c.recoveryDeferred = false
+		for key, ts := range c.seqs {
+			if req := c.request([]byte(key), ts); req != nil {
+				reqs = append(reqs, req)
+			}
+		}
+	}
+	c.seqMu.Unlock()
+
+	for _, req := range reqs {
+		c.send(req)
+	}
+}
+
+// Returns the history request for the first gap of target, or nil if there
+// is no gap, a request is already outstanding or waiting to be sent again, or
+// there is no room for the replay yet. Must be called with c.seqMu held.
+func (c *Conn) request(target []byte, ts *targetSeqs) *proto.MsgHistory {
+	if ts.pending || ts.retry != nil || len(ts.gaps) == 0 {
+		return nil
+	}
+	if !c.room() {
+		c.recoveryDeferred = true
+		return nil
+	}
+	g := ts.gaps[0]
+	ts.pending = true
+	ts.progress = false
+	since, count := g.first-1, g.last-g.first+1
+	return &proto.MsgHistory{Target: target, Since: &since, Count: &count}
+}
+
+// Joins target. The server answers with MsgJoined or MsgError.
+func (c *Conn) Join(target []byte) error {
+	return c.send(&proto.MsgJoin{Target: target})
+}
+
+// Sends payload to every member of target. The server answers with MsgAck or
+// MsgError.
+func (c *Conn) Send(target, payload []byte) error {
+	return c.send(&proto.MsgMsg{Target: target, Payload: payload})
+}
+
+// Leaves target. The server answers with MsgParted or MsgError.
+func (c *Conn) Part(target []byte) error {
+	return c.send(&proto.MsgPart{Target: target})
+}
+
+// Requests the last count stored messages of target, which must have been
+// joined. The server answers with a MsgDeliver for each, oldest first,
+// followed by MsgHistoryEnd; or with MsgError.
+func (c *Conn) HistoryLast(target []byte, count uint) error {
+	return c.send(&proto.MsgHistory{Target: target, Count: &count})
+}
+
+// Requests up to count stored messages of target following sequence number
+// since. The server answers as for HistoryLast.
+func (c *Conn) HistorySince(target []byte, since, count uint) error {
+	return c.send(&proto.MsgHistory{Target: target, Since: &since, Count: &count})
+}
+
+// Pings the server and waits for its answer, returning the round-trip time.
+// The result is also remembered for RTT.
+func (c *Conn) Ping(ctx context.Context) (time.Duration, error) {
+	if c.version < proto.PingVersion {
+		return 0, fmt.Errorf("Protocol version %d does not support pings", c.version)
+	}
+
+	ch := make(chan struct{})
+	c.pingMu.Lock()
+	c.pingNonce++
+	nonce := c.pingNonce
+	c.pings[nonce] = ch
+	c.pingMu.Unlock()
+	defer func() {
+		c.pingMu.Lock()
+		delete(c.pings, nonce)
+		c.pingMu.Unlock()
+	}()
+
+	start := time.Now()
+	err := c.send(&proto.MsgPing{Nonce: nonce})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-ch:
+	case <-c.ended:
+		return 0, c.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	rtt := time.Since(start)
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	return rtt, nil
+}
+
+// Returns the round-trip time measured by the last successful Ping, or zero
+// if there was none.
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// Wakes the Ping waiting for msg, if any.
+func (c *Conn) pong(msg *proto.MsgPong) {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+
+	if ch, ok := c.pings[msg.Nonce]; ok {
+		close(ch)
+		delete(c.pings, msg.Nonce)
+	}
+}
+
+func (c *Conn) send(val proto.Msg) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return proto.EncodeMsgSend(c.w, &val)
+}
+
+// Returns the next message from the server, such as *MsgDeliver or
+// *MsgError. Once the connection has ended and every message received has
+// been returned, Recv returns net.ErrClosed if it was closed with Close,
+// ErrServerClosed if the server closed it, or the error that ended it.
+func (c *Conn) Recv(ctx context.Context) (proto.Msg, error) {
+	for {
+		c.inMu.Lock()
+		if len(c.in) > 0 {
+			msg := c.in[0]
+			c.in[0] = nil
+			c.in = c.in[1:]
+			more := len(c.in) > 0
+			freed := false
+			if _, ok := msg.(*proto.MsgDeliver); ok {
+				c.inDeliveries--
+				freed = c.inDeliveries == c.maxIn-1
+			}
+			c.inMu.Unlock()
+			if more {
+				// Another Recv may be waiting too.
+				c.wake()
+			}
+			if freed {
+				c.resumeRecovery()
+			}
+			return msg, nil
+		}
+		err := c.err
+		c.inMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-c.inWake:
+		case <-c.ended:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Closes the connection. Messages already received can still be read with
+// Recv.
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.nc.Close()
+	})
+	return err
+}
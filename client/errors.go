@@ -0,0 +1,37 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"lotor/proto"
+)
+
+// An Error is a MsgError sent by the server in response to a step the Conn
+// waits on, such as the handshake or authentication.
+type Error struct {
+	Code    proto.ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Returned when the server answers with a message the Conn did not expect.
+type UnexpectedMessageError struct {
+	Msg proto.Msg
+}
+
+func (e *UnexpectedMessageError) Error() string {
+	return fmt.Sprintf("Unexpected message type %T", e.Msg)
+}
+
+// Returned when WithExternalAuth is given but the server does not offer the
+// external-auth capability, such as servers which predate it.
+var ErrNoExternalAuth = errors.New("Server does not offer external authentication")
+
+// Returned by Recv once the server has closed a Conn which was not closed
+// with Close, such as when the server disconnects an idle or misbehaving
+// client.
+var ErrServerClosed = errors.New("Connection closed by server")
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+
+	"lotor/capture"
+	"lotor/faultnet"
+	"lotor/proto"
+)
+
+// An Option configures a Conn created by Dial or NewConn.
+type Option func(*options)
+
+type options struct {
+	capabilities []string
+	recvBuffer   int
+
+	// Sent after the handshake if not nil.
+	auth proto.Msg
+	// Signs the server's challenge if auth is a MsgAuthKey.
+	key ed25519.PrivateKey
+
+	// If not nil, Dial connects with TLS.
+	tls *tls.Config
+
+	// If not nil, records every frame sent and received.
+	capture *capture.Writer
+
+	// If not nil, Dial injects faults into the connection.
+	faults *faultnet.Config
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		capabilities: []string{proto.CapAcks, proto.CapHistory},
+		recvBuffer:   1024,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if _, ok := o.auth.(*proto.MsgAuthExternal); ok {
+		o.capabilities = append(o.capabilities[:len(o.capabilities):len(o.capabilities)], proto.CapExternalAuth)
+	}
+	return o
+}
+
+// Sets the capabilities offered to the server in MsgHello. By default, every
+// capability this package understands is offered.
+func WithCapabilities(caps ...string) Option {
+	return func(o *options) {
+		o.capabilities = caps
+	}
+}
+
+// Sets how many deliveries may wait to be returned by Recv, 1024 by default.
+// Further deliveries are dropped until Recv makes room; they are recovered
+// from the history if the server offers it.
+func WithRecvBuffer(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.recvBuffer = n
+	}
+}
+
+// Logs in with PLAIN password authentication after the handshake.
+func WithPassword(identity, password string) Option {
+	return func(o *options) {
+		o.auth = &proto.MsgAuthPlain{Identity: identity, Password: password}
+	}
+}
+
+// Logs in with a bearer token after the handshake.
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.auth = &proto.MsgAuthToken{Token: token}
+	}
+}
+
+// Logs in as identity with ed25519 challenge-response authentication after
+// the handshake, signing the server's challenge with key.
+func WithKey(identity string, key ed25519.PrivateKey) Option {
+	return func(o *options) {
+		o.auth = &proto.MsgAuthKey{Identity: identity}
+		o.key = key
+	}
+}
+
+// Logs in as the identity established by the transport after the handshake,
+// such as the subject of the TLS client certificate given with WithTLS. If
+// identity is not empty, the server checks that it matches. The external-auth
+// capability is offered along with the others; if the server does not offer
+// it back, the Conn fails with ErrNoExternalAuth.
+func WithExternalAuth(identity string) Option {
+	return func(o *options) {
+		msg := &proto.MsgAuthExternal{}
+		if identity != "" {
+			msg.Identity = &identity
+		}
+		o.auth = msg
+	}
+}
+
+// Makes Dial connect over TLS with the given configuration. If it does not
+// set ServerName, the host part of the address is used. It has no effect on
+// NewConn.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tls = config
+	}
+}
+
+// Records every frame sent and received on the Conn, starting with the
+// handshake, into w. The capture should be created with the CLIENT role; it
+// is not closed by the Conn.
+func WithCapture(w *capture.Writer) Option {
+	return func(o *options) {
+		o.capture = w
+	}
+}
+
+// Makes Dial inject the faults described by config into the frames it sends,
+// for chaos testing. With WithTLS, faults are injected before encryption. It
+// has no effect on NewConn, which can be given a faultnet.Conn instead.
+func WithFaults(config faultnet.Config) Option {
+	return func(o *options) {
+		o.faults = &config
+	}
+}
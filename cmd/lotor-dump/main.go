@@ -0,0 +1,73 @@
+// Command lotor-dump decodes a framed Msg stream, as sent between lotor
+// clients and servers, and prints each message in a readable form.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"lotor/frame"
+)
+
+func main() {
+	maxFrame := flag.Uint64("max-frame", frame.DefaultMaxSize, "maximum frame size in bytes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: lotor-dump [flags] [file]\n\n"+
+			"Reads a framed Msg stream from file, or standard input if none is given.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	in := io.Reader(os.Stdin)
+	switch flag.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	ok := dump(out, in, *maxFrame)
+	out.Flush()
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// Prints every frame of r to w. Frames which do not decode are reported and
+// skipped; a broken frame layer ends the dump. Returns false if anything
+// could not be decoded.
+func dump(w io.Writer, r io.Reader, max uint64) bool {
+	fr := frame.NewReader(r, max)
+	ok := true
+
+	var offset uint64
+	for {
+		body, err := fr.ReadFrame()
+		if err == io.EOF {
+			return ok
+		} else if err != nil {
+			fmt.Fprintf(w, "%d: %v\n", offset, err)
+			return false
+		}
+
+		var scratch [binary.MaxVarintLen64]byte
+		start := offset + uint64(binary.PutUvarint(scratch[:], uint64(len(body))))
+		if !printFrame(w, offset, start, body) {
+			ok = false
+		}
+		offset = start + uint64(len(body))
+	}
+}
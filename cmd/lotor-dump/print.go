@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"lotor/bareish"
+	"lotor/proto"
+)
+
+// Decodes and prints the body of the frame at byte offset offset of the
+// stream, whose body starts at offset start. Decode errors are reported with
+// the offset at which decoding stopped. Returns false if the body is not a
+// valid Msg.
+func printFrame(w io.Writer, offset, start uint64, body []byte) bool {
+	// The union tag leads the encoding, so it can be shown even if the
+	// rest does not decode.
+	tag, n := binary.Uvarint(body)
+	if n <= 0 {
+		fmt.Fprintf(w, "%d: decode error at offset %d: bad union tag\n", offset, start)
+		return false
+	}
+
+	br := bytes.NewReader(body)
+	var msg proto.Msg
+	err := bareish.UnmarshalBareReader(bareish.NewReader(br), &msg)
+	read := uint64(len(body) - br.Len())
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = errors.New("message ends early")
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%d: [%d] decode error at offset %d: %v\n", offset, tag, start+read, err)
+		return false
+	}
+
+	v := reflect.ValueOf(msg).Elem()
+	fmt.Fprintf(w, "%d: [%d] %s ", offset, tag, v.Type().Name())
+	printValue(w, v, 0)
+	fmt.Fprintln(w)
+	if rest := br.Len(); rest > 0 {
+		fmt.Fprintf(w, "%d: %d trailing bytes at offset %d\n", offset, rest, start+read)
+		return false
+	}
+	return true
+}
+
+// Prints v, indenting nested lines by depth tabs.
+func printValue(w io.Writer, v reflect.Value, depth int) {
+	if s, ok := v.Interface().(fmt.Stringer); ok {
+		fmt.Fprint(w, s.String())
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			fmt.Fprint(w, "none")
+		} else {
+			printValue(w, v.Elem(), depth)
+		}
+	case reflect.Struct:
+		fmt.Fprintln(w, "{")
+		for i := 0; i < v.NumField(); i++ {
+			fmt.Fprintf(w, "%s%s: ", strings.Repeat("\t", depth+1), fieldName(v.Type().Field(i)))
+			printValue(w, v.Field(i), depth+1)
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s}", strings.Repeat("\t", depth))
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			printData(w, data)
+			return
+		}
+		fmt.Fprint(w, "[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				fmt.Fprint(w, ", ")
+			}
+			printValue(w, v.Index(i), depth)
+		}
+		fmt.Fprint(w, "]")
+	case reflect.String:
+		fmt.Fprint(w, strconv.Quote(v.String()))
+	default:
+		fmt.Fprint(w, v.Interface())
+	}
+}
+
+// Prints data as a quoted string if it is valid UTF-8, and in hex otherwise.
+func printData(w io.Writer, data []byte) {
+	if utf8.Valid(data) {
+		fmt.Fprint(w, strconv.Quote(string(data)))
+	} else {
+		fmt.Fprintf(w, "hex:%s", hex.EncodeToString(data))
+	}
+}
+
+// Returns the schema name of a struct field, from its bare tag.
+func fieldName(f reflect.StructField) string {
+	if tag, ok := f.Tag.Lookup("bare"); ok {
+		return strings.SplitN(tag, ",", 2)[0]
+	}
+	return f.Name
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"lotor/frame"
+)
+
+// Enum values outside the schema, which a newer peer may send, are printed
+// as numbers rather than ending the dump.
+func TestDumpUnknownEnum(t *testing.T) {
+	for _, tc := range []struct {
+		code byte
+		want string
+	}{
+		{0x01, "code: ERR_UNEXPECTED\n"},
+		{0x63, "code: ErrorCode(99)\n"},
+	} {
+		var out bytes.Buffer
+		in := []byte{0x05, 0x07, tc.code, 0x00, 0x01, 'x'}
+		if !dump(&out, bytes.NewReader(in), frame.DefaultMaxSize) {
+			t.Fatalf("dump failed:\n%s", out.String())
+		}
+		if !strings.Contains(out.String(), tc.want) || !strings.Contains(out.String(), `message: "x"`) {
+			t.Errorf("expected %q in:\n%s", tc.want, out.String())
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Command lotor-replay plays one side of a recorded lotor connection back
+// against a live server or client, with the original timing, to reproduce
+// what happened on it.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"lotor/capture"
+	"lotor/frame"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("lotor-replay: ")
+
+	network := flag.String("network", "tcp", "network of the -connect and -listen addresses: tcp or unix")
+	connect := flag.String("connect", "", "play the client's side of the capture to the server at this address")
+	listen := flag.String("listen", "", "play the server's side of the capture to the first client connecting to this address")
+	fast := flag.Bool("fast", false, "send frames as fast as possible instead of with their recorded timing")
+	wait := flag.Duration("wait", time.Second, "how long to keep reading from the peer after the last frame was sent")
+	record := flag.String("capture", "", "record the replayed connection into this capture file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: lotor-replay -connect ADDR | -listen ADDR [flags] FILE\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || (*connect == "") == (*listen == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	cr, err := capture.NewReader(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		nc   net.Conn
+		side capture.Role
+	)
+	if *connect != "" {
+		side = capture.CLIENT
+		nc, err = net.Dial(*network, *connect)
+	} else {
+		side = capture.SERVER
+		nc, err = accept(*network, *listen)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer nc.Close()
+
+	var (
+		r frame.ReadFramer  = frame.NewReader(nc, capture.MaxRecordSize)
+		w frame.WriteFramer = frame.NewWriter(nc, capture.MaxRecordSize)
+	)
+	if *record != "" {
+		cw, err := capture.Create(*record, side)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cw.Close()
+		r, w = cw.Reader(r), cw.Writer(w)
+	}
+
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		for {
+			_, err := r.ReadFrame()
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					log.Printf("read: %v", err)
+				}
+				break
+			}
+			n++
+		}
+		received <- n
+	}()
+
+	sent, err := replay(cr, side, w, *fast)
+	if err != nil {
+		log.Printf("replay: %v", err)
+	}
+
+	var n int
+	select {
+	case n = <-received:
+	case <-time.After(*wait):
+		nc.Close()
+		n = <-received
+	}
+	log.Printf("sent %d frames, received %d", sent, n)
+}
+
+// Waits for a single connection on addr.
+func accept(network, addr string) (net.Conn, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	log.Printf("waiting for a client on %s", l.Addr())
+	return l.Accept()
+}
+
+// Writes every frame of the capture which was sent by side to w, at the same
+// time relative to the start of the replay as it was recorded, unless fast
+// is set. Returns the number of frames written.
+func replay(cr *capture.Reader, side capture.Role, w frame.WriteFramer, fast bool) (int, error) {
+	start := time.Now()
+	sent := 0
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return sent, nil
+		} else if err != nil {
+			return sent, err
+		}
+
+		// A capture records its own side's frames as sent and the other
+		// side's frames as received.
+		if (cr.Header.Role == side) != (rec.Direction == capture.SENT) {
+			continue
+		}
+		if !fast {
+			time.Sleep(time.Until(start.Add(time.Duration(rec.Time))))
+		}
+		err = w.WriteFrame(rec.Body)
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+}
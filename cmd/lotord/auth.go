@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"lotor/proto"
+)
+
+// An authenticator checks the credentials carried by an auth message. It
+// returns the authenticated identity, or false if the credentials are
+// rejected or are of a kind it does not handle.
+type authenticator interface {
+	authenticate(msg proto.Msg) (string, bool)
+	// Reports whether identity can log in with this authenticator.
+	knows(identity string) bool
+}
+
+const saltSize = 16
+
+// Number of PBKDF2 iterations used by lotord -mkpasswd.
+const passwordIterations = 600000
+
+// Returns the hash stored in password files: a single 32-byte block of
+// PBKDF2-HMAC-SHA256, as specified by RFC 8018.
+func hashPassword(salt []byte, iterations int, password string) []byte {
+	prf := hmac.New(sha256.New, []byte(password))
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+
+	hash := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range hash {
+			hash[j] ^= u[j]
+		}
+	}
+	return hash
+}
+
+// Authenticates MsgAuthPlain against a password file. Each line of the file
+// holds an identity, the number of PBKDF2 iterations, a hex-encoded salt and
+// the hex-encoded hash of the password, as printed by lotord -mkpasswd.
+type passwordFile struct {
+	entries map[string]passwordEntry
+	// Checked against when the identity is unknown, so that the time
+	// taken does not tell which identities exist.
+	dummy passwordEntry
+}
+
+type passwordEntry struct {
+	iterations int
+	salt       []byte
+	hash       []byte
+}
+
+func loadPasswordFile(path string) (*passwordFile, error) {
+	lines, err := readFields(path, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &passwordFile{
+		entries: make(map[string]passwordEntry),
+		dummy: passwordEntry{
+			iterations: passwordIterations,
+			salt:       make([]byte, saltSize),
+			hash:       make([]byte, sha256.Size),
+		},
+	}
+	for _, fields := range lines {
+		iterations, err := strconv.Atoi(fields[1])
+		if err != nil || iterations < 1 {
+			return nil, fmt.Errorf("%s: bad iteration count for %s", path, fields[0])
+		}
+		salt, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad salt for %s: %v", path, fields[0], err)
+		}
+		hash, err := hex.DecodeString(fields[3])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s: bad hash for %s", path, fields[0])
+		}
+		entry := passwordEntry{iterations: iterations, salt: salt, hash: hash}
+		f.entries[fields[0]] = entry
+		// Unknown identities should cost as much as the most expensive
+		// known one.
+		if iterations > f.dummy.iterations {
+			f.dummy.iterations = iterations
+		}
+	}
+	return f, nil
+}
+
+func (f *passwordFile) authenticate(msg proto.Msg) (string, bool) {
+	auth, ok := msg.(*proto.MsgAuthPlain)
+	if !ok {
+		return "", false
+	}
+
+	entry, ok := f.entries[auth.Identity]
+	if !ok {
+		entry = f.dummy
+	}
+
+	hash := hashPassword(entry.salt, entry.iterations, auth.Password)
+	if subtle.ConstantTimeCompare(hash, entry.hash) != 1 || !ok {
+		return "", false
+	}
+	return auth.Identity, true
+}
+
+func (f *passwordFile) knows(identity string) bool {
+	_, ok := f.entries[identity]
+	return ok
+}
+
+// Authenticates MsgAuthToken against a file of static bearer tokens. Each
+// line of the file holds an identity and its token. Tokens are kept hashed
+// in memory so that lookups do not depend on how much of a token matched.
+type tokenFile struct {
+	identities map[[sha256.Size]byte]string
+	known      map[string]bool
+}
+
+func loadTokenFile(path string) (*tokenFile, error) {
+	lines, err := readFields(path, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newTokenFile()
+	for _, fields := range lines {
+		f.add(fields[0], fields[1])
+	}
+	return f, nil
+}
+
+func newTokenFile() *tokenFile {
+	return &tokenFile{
+		identities: make(map[[sha256.Size]byte]string),
+		known:      make(map[string]bool),
+	}
+}
+
+func (f *tokenFile) add(identity, token string) {
+	f.identities[sha256.Sum256([]byte(token))] = identity
+	f.known[identity] = true
+}
+
+func (f *tokenFile) authenticate(msg proto.Msg) (string, bool) {
+	auth, ok := msg.(*proto.MsgAuthToken)
+	if !ok {
+		return "", false
+	}
+
+	identity, ok := f.identities[sha256.Sum256([]byte(auth.Token))]
+	return identity, ok
+}
+
+func (f *tokenFile) knows(identity string) bool {
+	return f.known[identity]
+}
+
+// Reads a password from the first line of r and writes a password file line
+// for identity to w.
+func mkpasswd(w io.Writer, r io.Reader, identity string) error {
+	password, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || password == "") {
+		return errors.New("Expected a password on standard input")
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	salt := make([]byte, saltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s %d %x %x\n", identity, passwordIterations, salt,
+		hashPassword(salt, passwordIterations, password))
+	return err
+}
+
+const nonceSize = 32
+
+// Public keys for ed25519 challenge-response authentication. Each line of the
+// registry file holds an identity and its base64-encoded public key.
+type keyRegistry struct {
+	keys map[string]ed25519.PublicKey
+}
+
+func loadKeyRegistry(path string) (*keyRegistry, error) {
+	lines, err := readFields(path, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	reg := &keyRegistry{keys: make(map[string]ed25519.PublicKey)}
+	for _, fields := range lines {
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: bad public key for %s", path, fields[0])
+		}
+		reg.keys[fields[0]] = ed25519.PublicKey(key)
+	}
+	return reg, nil
+}
+
+func (reg *keyRegistry) knows(identity string) bool {
+	_, ok := reg.keys[identity]
+	return ok
+}
+
+// Reports whether sig is a valid signature of the challenge nonce by the key
+// registered for identity.
+func (reg *keyRegistry) verify(identity string, nonce, sig []byte) bool {
+	key, ok := reg.keys[identity]
+	if !ok {
+		return false
+	}
+	return ed25519.Verify(key, proto.ChallengeMessage(nonce), sig)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
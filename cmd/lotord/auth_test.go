@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+
+	"lotor/proto"
+)
+
+// The first block of the PBKDF2-HMAC-SHA256 test vectors of RFC 7914,
+// section 11.
+func TestHashPassword(t *testing.T) {
+	for _, test := range []struct {
+		password, salt string
+		iterations     int
+		hash           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"},
+	} {
+		want, _ := hex.DecodeString(test.hash)
+		got := hashPassword([]byte(test.salt), test.iterations, test.password)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q with %d iterations: got %x, want %x", test.password, test.iterations, got, want)
+		}
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	var line strings.Builder
+	err := mkpasswd(&line, strings.NewReader("hunter2\n"), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir() + "/passwords"
+	err = os.WriteFile(path, []byte(line.String()), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := loadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		identity, password string
+		ok                 bool
+	}{
+		{"alice", "hunter2", true},
+		{"alice", "hunter3", false},
+		{"bob", "hunter2", false},
+	} {
+		_, ok := f.authenticate(&proto.MsgAuthPlain{Identity: test.identity, Password: test.password})
+		if ok != test.ok {
+			t.Errorf("%s with %q: got %v, want %v", test.identity, test.password, ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lotor/capture"
+	"lotor/frame"
+)
+
+// A capturedTransport records every frame of a connection.
+type capturedTransport struct {
+	transport
+	r frame.ReadFramer
+	w frame.WriteFramer
+}
+
+func newCapturedTransport(t transport, cw *capture.Writer) *capturedTransport {
+	return &capturedTransport{
+		transport: t,
+		r:         cw.Reader(t),
+		w:         cw.Writer(t),
+	}
+}
+
+func (t *capturedTransport) ReadFrame() ([]byte, error) {
+	return t.r.ReadFrame()
+}
+
+func (t *capturedTransport) WriteFrame(body []byte) error {
+	return t.w.WriteFrame(body)
+}
+
+// Creates a capture file in dir for the connection called name.
+func createCapture(dir, name string) (*capture.Writer, error) {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	stamp := time.Now().UTC().Format("20060102T150405.000000000Z")
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.cap", stamp, safe))
+	return capture.Create(path, capture.SERVER)
+}
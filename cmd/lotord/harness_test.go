@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"lotor/client"
+	"lotor/faultnet"
+	"lotor/frame"
+	"lotor/proto"
+)
+
+// How long tests wait for a message before failing.
+const recvTimeout = 2 * time.Second
+
+// A pipeListener is an in-memory net.Listener. Each Dial creates a net.Pipe
+// and hands its server end to Accept.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+
+	mu sync.Mutex
+	n  int
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-l.conns:
+		return nc, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr("lotord")
+}
+
+// Connects to the listener. Every connection gets a remote address of its
+// own, since anonymous clients are identified by it.
+func (l *pipeListener) Dial() (net.Conn, error) {
+	l.mu.Lock()
+	l.n++
+	name := pipeAddr(fmt.Sprintf("pipe%d", l.n))
+	l.mu.Unlock()
+
+	server, client := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{server, name}:
+		return client, nil
+	case <-l.done:
+		server.Close()
+		client.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// A harness runs a lotord server in-process on a pipeListener.
+type harness struct {
+	t   *testing.T
+	srv *server
+	l   *pipeListener
+
+	// If not nil, faults are injected into both ends of every connection.
+	faults *faultnet.Config
+	dials  int64
+}
+
+// Starts a server with the same defaults as lotord, without rate limits, for
+// the duration of the test. The configure functions may change the harness
+// and its server before it starts.
+func newHarness(t *testing.T, configure ...func(*harness)) *harness {
+	t.Helper()
+
+	srv := &server{
+		maxFrame:    frame.DefaultMaxSize,
+		maxPayload:  64 * 1024,
+		maxReplay:   1000,
+		hub:         newHub(nil, newMailboxes(100, 1024*1024, time.Hour)),
+		limits:      newLimiter(nil),
+		maxStrikes:  10,
+		authLimits:  newLimiter(nil),
+		authSlots:   make(chan struct{}, 4),
+		queueSize:   256,
+		queuePolicy: dropOldest,
+	}
+	h := &harness{t: t, srv: srv, l: newPipeListener()}
+	for _, f := range configure {
+		f(h)
+	}
+
+	var l net.Listener = h.l
+	if h.faults != nil {
+		l = faultnet.WrapListener(l, *h.faults)
+	}
+	go srv.serve(l)
+	t.Cleanup(func() {
+		h.l.Close()
+	})
+	return h
+}
+
+// Enables token authentication with the given tokens, by identity.
+func withTokens(tokens map[string]string) func(*harness) {
+	return func(h *harness) {
+		f := newTokenFile()
+		for identity, token := range tokens {
+			f.add(identity, token)
+		}
+		h.srv.auth = append(h.srv.auth, f)
+	}
+}
+
+// Enables history, stored in a temporary directory.
+func withHistory(h *harness) {
+	hist, err := openHistory(h.t.TempDir())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.srv.hub.history = hist
+}
+
+// Injects the faults described by cfg into both ends of every connection.
+// Server ends use seeds counting up from the seed of cfg, and client ends
+// seeds counting down from it.
+func withFaults(cfg faultnet.Config) func(*harness) {
+	return func(h *harness) {
+		h.faults = &cfg
+	}
+}
+
+// Connects a client, which is closed at the end of the test.
+func (h *harness) dial(opts ...client.Option) *testClient {
+	h.t.Helper()
+
+	nc, err := h.l.Dial()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if h.faults != nil {
+		h.dials++
+		cfg := *h.faults
+		cfg.Seed -= h.dials
+		nc = faultnet.Wrap(nc, cfg)
+	}
+	c, err := client.NewConn(nc, opts...)
+	if err != nil {
+		h.t.Fatalf("handshake: %v", err)
+	}
+	h.t.Cleanup(func() {
+		c.Close()
+	})
+	return &testClient{t: h.t, Conn: c}
+}
+
+// Connects a client whose connection can be stalled, which is closed at the
+// end of the test.
+func (h *harness) dialStallable(opts ...client.Option) (*testClient, *stallConn) {
+	h.t.Helper()
+
+	nc, err := h.l.Dial()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	sc := &stallConn{Conn: nc}
+	c, err := client.NewConn(sc, opts...)
+	if err != nil {
+		h.t.Fatalf("handshake: %v", err)
+	}
+	h.t.Cleanup(func() {
+		sc.resume()
+		c.Close()
+	})
+	return &testClient{t: h.t, Conn: c}, sc
+}
+
+// A stallConn stops reading while stalled, like a client too busy to read,
+// so that the server's outbound queue for it fills up.
+type stallConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+func (c *stallConn) stall() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+func (c *stallConn) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+func (c *stallConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+
+	if resumed != nil {
+		<-resumed
+	}
+	return c.Conn.Read(b)
+}
+
+// Connects n clients with the same options.
+func (h *harness) dialN(n int, opts ...client.Option) []*testClient {
+	h.t.Helper()
+
+	clients := make([]*testClient, n)
+	for i := range clients {
+		clients[i] = h.dial(opts...)
+	}
+	return clients
+}
+
+// Connects without the client library, for tests which break the protocol.
+// Returns the frame reader and writer of the connection.
+func (h *harness) dialRaw() (*frame.Reader, *frame.Writer) {
+	h.t.Helper()
+
+	nc, err := h.l.Dial()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() {
+		nc.Close()
+	})
+	return frame.NewReader(nc, frame.DefaultMaxSize), frame.NewWriter(nc, frame.DefaultMaxSize)
+}
+
+// A testClient wraps a client.Conn with helpers which fail the test.
+type testClient struct {
+	t *testing.T
+	*client.Conn
+}
+
+// Returns the next message, failing the test if none arrives in time.
+func (c *testClient) recv() proto.Msg {
+	c.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), recvTimeout)
+	defer cancel()
+	msg, err := c.Recv(ctx)
+	if err != nil {
+		c.t.Fatalf("%s: receive: %v", c.Identity(), err)
+	}
+	return msg
+}
+
+// Checks that nothing arrives for d.
+func (c *testClient) expectNothing(d time.Duration) {
+	c.t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	msg, err := c.Recv(ctx)
+	if err == nil {
+		c.t.Fatalf("%s: unexpected %T %+v", c.Identity(), msg, msg)
+	}
+}
+
+// Joins target and waits for the confirmation.
+func (c *testClient) join(target string) {
+	c.t.Helper()
+
+	err := c.Join([]byte(target))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	joined, ok := c.recv().(*proto.MsgJoined)
+	if !ok || string(joined.Target) != target {
+		c.t.Fatalf("expected MsgJoined for %q, got %+v", target, joined)
+	}
+}
+
+// Sends payload to target without waiting for an answer.
+func (c *testClient) send(target, payload string) {
+	c.t.Helper()
+
+	err := c.Send([]byte(target), []byte(payload))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Expects the next message to deliver payload from sender on target, and
+// returns it.
+func (c *testClient) expectDeliver(sender, target, payload string) *proto.MsgDeliver {
+	c.t.Helper()
+
+	msg := c.recv()
+	d, ok := msg.(*proto.MsgDeliver)
+	if !ok {
+		c.t.Fatalf("expected MsgDeliver, got %T %+v", msg, msg)
+	}
+	if d.Sender != sender || string(d.Target) != target || !bytes.Equal(d.Payload, []byte(payload)) {
+		c.t.Fatalf("expected %q from %q on %q, got %q from %q on %q",
+			payload, sender, target, d.Payload, d.Sender, d.Target)
+	}
+	return d
+}
+
+// Expects the next message to acknowledge a message on target, and returns
+// its sequence number.
+func (c *testClient) expectAck(target string) uint {
+	c.t.Helper()
+
+	msg := c.recv()
+	ack, ok := msg.(*proto.MsgAck)
+	if !ok || string(ack.Target) != target {
+		c.t.Fatalf("expected MsgAck for %q, got %T %+v", target, msg, msg)
+	}
+	return ack.Seq
+}
+
+// Expects the next message to be an error with the given code.
+func (c *testClient) expectError(code proto.ErrorCode) *proto.MsgError {
+	c.t.Helper()
+
+	msg := c.recv()
+	e, ok := msg.(*proto.MsgError)
+	if !ok || e.Code != code {
+		c.t.Fatalf("expected %s, got %T %+v", code, msg, msg)
+	}
+	return e
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"lotor/bareish"
+	"lotor/frame"
+)
+
+// Upper bound on the size of a stored record, used to reject garbage length
+// prefixes when scanning a log.
+const maxRecordSize = 32 * 1024 * 1024 /* 32 MiB */
+
+// Maximum number of logs kept in memory, each with its file open and its
+// index built. The least recently used log is dropped to make room for
+// another, and its file is scanned again when it is next used, so that memory
+// does not grow with every target ever written to.
+const maxOpenLogs = 256
+
+// The first frame of a log file is a historyHeader naming its target, since
+// the file name is only a hash of it.
+type historyHeader struct {
+	Target []byte `bare:"target"`
+}
+
+// A historyRecord is one accepted message as stored in a target's log.
+type historyRecord struct {
+	Seq     uint64 `bare:"seq"`
+	Time    int64  `bare:"time"`
+	Sender  string `bare:"sender"`
+	Payload []byte `bare:"payload"`
+}
+
+// Each record is stored in the log as one frame holding a historyEntry: the
+// BARE-encoded historyRecord and a CRC-32 of it, so that a record which was
+// only partially written before a crash can be told apart from a good one.
+type historyEntry struct {
+	Checksum uint32 `bare:"checksum"`
+	Record   []byte `bare:"record"`
+}
+
+var errBadChecksum = errors.New("Record checksum mismatch")
+
+func encodeEntry(rec *historyRecord) ([]byte, error) {
+	data, err := bareish.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return bareish.Marshal(&historyEntry{
+		Checksum: crc32.ChecksumIEEE(data),
+		Record:   data,
+	})
+}
+
+func decodeEntry(body []byte, rec *historyRecord) error {
+	var entry historyEntry
+	err := bareish.Unmarshal(body, &entry)
+	if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(entry.Record) != entry.Checksum {
+		return errBadChecksum
+	}
+	return bareish.Unmarshal(entry.Record, rec)
+}
+
+// Returns the number of bytes a frame with the given body occupies.
+func frameSize(body []byte) int64 {
+	var scratch [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(scratch[:], uint64(len(body))) + len(body))
+}
+
+// A history stores the accepted messages of every target in a directory,
+// with one append-only log file per target, named after the SHA-256 hash of
+// the target. It is safe for concurrent use.
+//
+// The lock of the history is never taken to wait for the lock of a log, so
+// that slow disk access for one target does not hold up the others.
+type history struct {
+	dir string
+
+	mu   sync.Mutex
+	logs map[string]*targetLog
+	// The logs in logs, most recently used first.
+	open *list.List
+}
+
+func openHistory(dir string) (*history, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	return &history{
+		dir:  dir,
+		logs: make(map[string]*targetLog),
+		open: list.New(),
+	}, nil
+}
+
+// Returns the log of target, scanning its file if it was not used yet. If the
+// file does not exist, it is created if create is set, and nil is returned
+// otherwise. A log is scanned while holding its own lock, which its other
+// users wait for, rather than the lock of the history.
+func (h *history) log(target []byte, create bool) (*targetLog, error) {
+	key := string(target)
+	h.mu.Lock()
+	if l, ok := h.logs[key]; ok {
+		h.mu.Unlock()
+		return l, nil
+	}
+	sum := sha256.Sum256(target)
+	l := &targetLog{
+		h:      h,
+		target: []byte(key),
+		path:   filepath.Join(h.dir, hex.EncodeToString(sum[:])+".log"),
+	}
+	l.mu.Lock()
+	h.logs[key] = l
+	h.mu.Unlock()
+
+	evicted, err := l.load(create)
+	if err != nil || l.f == nil {
+		if l.f != nil {
+			l.f.Close()
+			l.f, l.w = nil, nil
+		}
+		l.removed = true
+		h.mu.Lock()
+		delete(h.logs, key)
+		if l.elem != nil {
+			h.open.Remove(l.elem)
+			l.elem = nil
+		}
+		h.mu.Unlock()
+	}
+	l.mu.Unlock()
+	h.closeEvicted(evicted)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", l.path, err)
+	} else if l.removed {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// Marks l as the most recently used log, and returns the logs to drop to make
+// room for it. Must be called with l.mu held.
+func (h *history) touch(l *targetLog) []*targetLog {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if l.elem != nil {
+		h.open.MoveToFront(l.elem)
+		return nil
+	}
+	l.elem = h.open.PushFront(l)
+	var evicted []*targetLog
+	for h.open.Len() > maxOpenLogs {
+		oldest := h.open.Remove(h.open.Back()).(*targetLog)
+		oldest.elem = nil
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+// Drops the logs returned by touch from the history, closing their files,
+// unless they were used again since. Users still holding one of them get
+// errLogRemoved and load the log again. Must be called without holding the
+// lock of any log.
+func (h *history) closeEvicted(logs []*targetLog) {
+	for _, l := range logs {
+		l.mu.Lock()
+		h.mu.Lock()
+		evicted := l.elem == nil
+		if evicted && h.logs[string(l.target)] == l {
+			delete(h.logs, string(l.target))
+		}
+		h.mu.Unlock()
+		if evicted {
+			l.closeFile()
+			l.removed = true
+			l.offsets = nil
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Appends rec to the log of its target, assigning its sequence number.
+func (h *history) append(target []byte, rec *historyRecord) error {
+	for {
+		l, err := h.log(target, true)
+		if err != nil {
+			return err
+		}
+		evicted, err := l.append(rec)
+		h.closeEvicted(evicted)
+		if err != errLogRemoved {
+			return err
+		}
+	}
+}
+
+// Returns the stored messages of target after sequence number since, or the
+// last ones if since is nil. At most count records are returned, and never
+// more than max.
+func (h *history) replay(target []byte, since, count *uint, max int) ([]historyRecord, error) {
+	n := max
+	if count != nil && *count < uint(n) {
+		n = int(*count)
+	}
+	for {
+		l, err := h.log(target, false)
+		if err != nil || l == nil {
+			return nil, err
+		}
+		records, evicted, err := l.read(since, n)
+		h.closeEvicted(evicted)
+		if err != errLogRemoved {
+			return records, err
+		}
+	}
+}
+
+// Returned by the methods of a targetLog which could not be loaded, whose
+// file did not exist, or which was dropped to make room for others, and which
+// was removed from the history. The caller
+// should get the log from the history again.
+var errLogRemoved = errors.New("Log removed")
+
+// A targetLog is the log file of a single target.
+type targetLog struct {
+	h      *history
+	target []byte
+	path   string
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *frame.Writer
+	removed bool
+
+	// offsets[i] is the file offset of the record with sequence number i+1.
+	offsets []int64
+	size    int64
+
+	// The position of the log in the open list of the history, or nil if
+	// it is being dropped. Guarded by the lock of the history.
+	elem *list.Element
+}
+
+// Opens the file of the log and scans it. If the file does not exist and
+// create is not set, l.f is left nil. Returns the logs to close to make room
+// for this one. Must be called with l.mu held.
+func (l *targetLog) load(create bool) ([]*targetLog, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(l.path, flags, 0o600)
+	if errors.Is(err, os.ErrNotExist) && !create {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	l.f = f
+	evicted := l.h.touch(l)
+	return evicted, l.scan()
+}
+
+// Closes the file of the log, if it is open. Must be called with l.mu held.
+func (l *targetLog) closeFile() {
+	if l.f != nil {
+		l.f.Close()
+		l.f, l.w = nil, nil
+	}
+}
+
+// Scans the log file, building its index, or writes its header if the file
+// is empty. If the log ends in a torn record, it is truncated to the end of
+// the last complete one. Any other damage is an error, so that no record is
+// lost without someone looking at the file. Must be called with l.mu held.
+func (l *targetLog) scan() error {
+	f, target := l.f, l.target
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+
+	r := frame.NewReader(f, maxRecordSize)
+	body, err := r.ReadFrame()
+	var truncated *frame.TruncatedError
+	if err == io.EOF || errors.As(err, &truncated) {
+		// A new log, or one whose header was torn while creating it.
+		return l.writeHeader()
+	} else if err != nil {
+		return fmt.Errorf("Header: %v", err)
+	}
+	var header historyHeader
+	err = bareish.Unmarshal(body, &header)
+	if err != nil {
+		return fmt.Errorf("Header: %v", err)
+	}
+	if !bytes.Equal(header.Target, target) {
+		return fmt.Errorf("Log belongs to target %q", header.Target)
+	}
+	l.size = frameSize(body)
+
+	for {
+		body, err := r.ReadFrame()
+		if err == io.EOF || errors.As(err, &truncated) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Record at offset %d: %v", l.size, err)
+		}
+
+		var rec historyRecord
+		err = decodeEntry(body, &rec)
+		if err == nil && rec.Seq != uint64(len(l.offsets))+1 {
+			err = fmt.Errorf("Sequence number %d, expected %d", rec.Seq, len(l.offsets)+1)
+		}
+		if err != nil {
+			if l.size+frameSize(body) == end {
+				break
+			}
+			return fmt.Errorf("Record at offset %d: %v", l.size, err)
+		}
+		l.offsets = append(l.offsets, l.size)
+		l.size += frameSize(body)
+	}
+
+	if end > l.size {
+		log.Printf("%s: truncating torn record at offset %d", f.Name(), l.size)
+		err = f.Truncate(l.size)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = f.Seek(l.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	l.w = frame.NewWriter(f, maxRecordSize)
+	return nil
+}
+
+// Replaces the contents of the file with the header of the log.
+func (l *targetLog) writeHeader() error {
+	body, err := bareish.Marshal(&historyHeader{Target: l.target})
+	if err != nil {
+		return err
+	}
+	err = l.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	l.w = frame.NewWriter(l.f, maxRecordSize)
+	err = l.w.WriteFrame(body)
+	if err != nil {
+		return err
+	}
+	l.size = frameSize(body)
+	return l.f.Sync()
+}
+
+func (l *targetLog) append(rec *historyRecord) ([]*targetLog, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.removed {
+		return nil, errLogRemoved
+	}
+	evicted := l.h.touch(l)
+	rec.Seq = uint64(len(l.offsets)) + 1
+	body, err := encodeEntry(rec)
+	if err != nil {
+		return evicted, err
+	}
+
+	err = l.w.WriteFrame(body)
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the record made it to the file, so that
+		// later appends do not land after a torn record.
+		l.f.Truncate(l.size)
+		l.f.Seek(l.size, io.SeekStart)
+		return evicted, err
+	}
+
+	l.offsets = append(l.offsets, l.size)
+	l.size += frameSize(body)
+	return evicted, nil
+}
+
+func (l *targetLog) read(since *uint, count int) ([]historyRecord, []*targetLog, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.removed {
+		return nil, nil, errLogRemoved
+	}
+
+	last := uint64(len(l.offsets))
+	first := uint64(0)
+	if since != nil {
+		first = uint64(*since)
+	} else if last > uint64(count) {
+		first = last - uint64(count)
+	}
+	if first >= last || count <= 0 {
+		return nil, nil, nil
+	}
+
+	evicted := l.h.touch(l)
+	r := frame.NewReader(io.NewSectionReader(l.f, l.offsets[first], l.size-l.offsets[first]), maxRecordSize)
+	var records []historyRecord
+	for seq := first + 1; seq <= last && len(records) < count; seq++ {
+		body, err := r.ReadFrame()
+		if err != nil {
+			return nil, evicted, err
+		}
+
+		var rec historyRecord
+		err = decodeEntry(body, &rec)
+		if err != nil {
+			return nil, evicted, err
+		}
+		records = append(records, rec)
+	}
+	return records, evicted, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Appends count records to target and returns the path and size of its log.
+func writeHistory(t *testing.T, dir string, target []byte, count int) (string, int64) {
+	t.Helper()
+
+	h, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		err := h.append(target, &historyRecord{Sender: "alice", Payload: []byte("hello")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := h.log(target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeLog(l)
+	return l.path, l.size
+}
+
+// Closes the file of l, so that the test can change it.
+func closeLog(l *targetLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeFile()
+}
+
+func TestHistoryTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	target := []byte("room")
+	path, size := writeHistory(t, dir, target, 3)
+
+	// A record cut short by a crash: the length prefix announces more
+	// bytes than follow it.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write([]byte{20, 1, 2, 3})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := h.replay(target, nil, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Seq != 1 || records[2].Seq != 3 {
+		t.Fatalf("expected records 1 to 3, got %+v", records)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Fatalf("expected the log to be truncated to %d bytes, it has %d", size, info.Size())
+	}
+
+	rec := &historyRecord{Sender: "alice", Payload: []byte("again")}
+	err = h.append(target, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Seq != 4 {
+		t.Fatalf("expected sequence number 4 after the torn record, got %d", rec.Seq)
+	}
+}
+
+func TestHistoryCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	target := []byte("room")
+	path, size := writeHistory(t, dir, target, 3)
+
+	// Flip the last byte of the first record, which is followed by good
+	// ones: the log must not be truncated to before it.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := h.log(target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[l.offsets[1]-1] ^= 0xff
+	closeLog(l)
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.replay(target, nil, nil, 10)
+	if err == nil {
+		t.Fatal("expected a corrupt record to be reported")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Fatalf("expected the log to keep its %d bytes, it has %d", size, info.Size())
+	}
+}
+
+func TestHistoryLongTarget(t *testing.T) {
+	dir := t.TempDir()
+	target := make([]byte, 1000)
+	for i := range target {
+		target[i] = 'x'
+	}
+	writeHistory(t, dir, target, 1)
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("expected one log file, got %v %v", matches, err)
+	}
+}
+
+func TestHistoryEvictsLogs(t *testing.T) {
+	h, err := openHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxOpenLogs+10; i++ {
+		err := h.append([]byte(fmt.Sprint("room", i)), &historyRecord{Payload: []byte("x")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h.open.Len() > maxOpenLogs {
+		t.Fatalf("%d logs open, expected at most %d", h.open.Len(), maxOpenLogs)
+	}
+
+	if len(h.logs) > maxOpenLogs {
+		t.Fatalf("%d logs in memory, expected at most %d", len(h.logs), maxOpenLogs)
+	}
+
+	// An evicted log is dropped along with its index, and scanned again
+	// when it is next used.
+	if _, ok := h.logs["room0"]; ok {
+		t.Fatal("expected room0 to be dropped")
+	}
+	records, err := h.replay([]byte("room0"), nil, nil, 10)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("expected the evicted log to be reopened, got %v %v", records, err)
+	}
+	err = h.append([]byte("room0"), &historyRecord{Payload: []byte("y")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := h.logs["room0"]; len(l.offsets) != 2 {
+		t.Fatalf("expected room0 to have 2 records, got %d", len(l.offsets))
+	}
+	if h.open.Len() > maxOpenLogs || len(h.logs) > maxOpenLogs {
+		t.Fatalf("%d logs open and %d in memory after reopening one, expected at most %d",
+			h.open.Len(), len(h.logs), maxOpenLogs)
+	}
+}
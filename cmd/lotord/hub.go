@@ -0,0 +1,332 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"lotor/proto"
+)
+
+// A hub tracks which connections have joined each target and fans messages
+// out to the current members of a target. It is safe for concurrent use.
+type hub struct {
+	mu      sync.RWMutex
+	members map[string]map[*conn]struct{}
+	joined  map[*conn]map[string]struct{}
+	seqs    map[string]*sequencer
+
+	// Connections of each logged-in identity, for user targets. Messages to
+	// identities without any connection go to their mailbox; both are
+	// guarded by mu so that a message cannot slip into a mailbox after its
+	// owner's login has emptied it.
+	users map[string]map[*conn]struct{}
+	mail  *mailboxes
+
+	// If not nil, every delivered message is stored here first.
+	history *history
+}
+
+// A sequencer orders the deliveries to one target. Its lock is held from the
+// assignment of a sequence number until the message has been queued for
+// every member, so that members see sequence numbers in increasing order.
+// Without history, it also holds the last sequence number assigned; with
+// history, the target's log does.
+//
+// Sequencers of targets nobody refers to anymore are dropped by sweep. Without
+// history, the sequence numbers of a target then start over.
+type sequencer struct {
+	mu   sync.Mutex
+	last uint64
+
+	// Number of deliveries using the sequencer, guarded by the hub lock.
+	refs int
+}
+
+func newHub(history *history, mail *mailboxes) *hub {
+	return &hub{
+		members: make(map[string]map[*conn]struct{}),
+		joined:  make(map[*conn]map[string]struct{}),
+		seqs:    make(map[string]*sequencer),
+		users:   make(map[string]map[*conn]struct{}),
+		mail:    mail,
+		history: history,
+	}
+}
+
+// Records c as logged in as identity, and queues the messages that were
+// waiting in its mailbox. They are queued before releasing the lock, so that
+// a delivery which finds c online cannot overtake them.
+func (h *hub) login(c *conn, identity string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conns, ok := h.users[identity]
+	if !ok {
+		conns = make(map[*conn]struct{})
+		h.users[identity] = conns
+	}
+	conns[c] = struct{}{}
+	for _, msg := range h.mail.take(identity) {
+		c.sendForced(msg)
+	}
+}
+
+// Records that c, logged in as identity, has gone away.
+func (h *hub) logout(c *conn, identity string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conns := h.users[identity]
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(h.users, identity)
+	}
+}
+
+// Adds c to the members of target. Returns false if c was already a member.
+func (h *hub) join(c *conn, target []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := string(target)
+	members, ok := h.members[key]
+	if !ok {
+		members = make(map[*conn]struct{})
+		h.members[key] = members
+	}
+	if _, ok := members[c]; ok {
+		return false
+	}
+	members[c] = struct{}{}
+
+	targets, ok := h.joined[c]
+	if !ok {
+		targets = make(map[string]struct{})
+		h.joined[c] = targets
+	}
+	targets[key] = struct{}{}
+	return true
+}
+
+// Removes c from the members of target. Returns false if c was not a member.
+func (h *hub) part(c *conn, target []byte) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.remove(c, string(target))
+}
+
+// Removes c from every target it has joined.
+func (h *hub) partAll(c *conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key := range h.joined[c] {
+		h.remove(c, key)
+	}
+}
+
+// Must be called with h.mu held.
+func (h *hub) remove(c *conn, key string) bool {
+	members, ok := h.members[key]
+	if !ok {
+		return false
+	}
+	if _, ok := members[c]; !ok {
+		return false
+	}
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.members, key)
+	}
+
+	targets := h.joined[c]
+	delete(targets, key)
+	if len(targets) == 0 {
+		delete(h.joined, c)
+	}
+	return true
+}
+
+// Reports whether c is a member of target.
+func (h *hub) isMember(c *conn, target []byte) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, ok := h.members[string(target)][c]
+	return ok
+}
+
+// Returns a snapshot of the current members of target, on behalf of sender.
+// The sender must itself be a member.
+func (h *hub) snapshot(sender *conn, target []byte) ([]*conn, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	members, ok := h.members[string(target)]
+	if !ok {
+		return nil, &protocolError{
+			code:    proto.ERR_UNKNOWN_TARGET,
+			target:  target,
+			message: "No such target",
+		}
+	}
+	if _, ok := members[sender]; !ok {
+		return nil, &protocolError{
+			code:    proto.ERR_NOT_JOINED,
+			target:  target,
+			message: "Not a member of this target",
+		}
+	}
+
+	conns := make([]*conn, 0, len(members))
+	for c := range members {
+		conns = append(conns, c)
+	}
+	return conns, nil
+}
+
+// Returns the sequencing state of target, creating it if needed. It must be
+// given back with release once the delivery is done.
+func (h *hub) sequencer(target []byte) *sequencer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := string(target)
+	seq, ok := h.seqs[key]
+	if !ok {
+		seq = &sequencer{}
+		h.seqs[key] = seq
+	}
+	seq.refs++
+	return seq
+}
+
+func (h *hub) release(seq *sequencer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seq.refs--
+}
+
+// Drops expired mail and the sequencers of targets which are not in use:
+// joinable targets without members, and user targets of users who are offline
+// and have no mail waiting. Runs every interval and never returns.
+func (h *hub) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		h.mail.expire()
+
+		h.mu.Lock()
+		for key, seq := range h.seqs {
+			if seq.refs > 0 || len(h.members[key]) > 0 {
+				continue
+			}
+			identity, user := proto.ParseUserTarget([]byte(key))
+			if user && (len(h.users[identity]) > 0 || h.mail.has(identity)) {
+				continue
+			}
+			delete(h.seqs, key)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Delivers msg from sender to every current member of its target, assigning
+// it the target's next sequence number and storing it in the history first if
+// enabled. Members are collected under the hub lock but sent to outside it,
+// so a slow member never blocks joins and parts on other connections. The
+// message is encoded once and the same bytes are queued for every member.
+func (h *hub) deliver(sender *conn, msg *proto.MsgDeliver) error {
+	conns, err := h.snapshot(sender, msg.Target)
+	if err != nil {
+		return err
+	}
+
+	seq := h.sequencer(msg.Target)
+	defer h.release(seq)
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+
+	msg.Time = time.Now().UnixNano()
+	if h.history != nil {
+		rec := &historyRecord{
+			Time:    msg.Time,
+			Sender:  msg.Sender,
+			Payload: msg.Payload,
+		}
+		err = h.history.append(msg.Target, rec)
+		if err != nil {
+			log.Printf("history: %q: %v", msg.Target, err)
+			return &protocolError{
+				code:    proto.ERR_INTERNAL,
+				target:  msg.Target,
+				message: "Failed to store message",
+			}
+		}
+		msg.Seq = uint(rec.Seq)
+	} else {
+		seq.last++
+		msg.Seq = uint(seq.last)
+	}
+
+	data, err := encodeDeliver(msg)
+	if err != nil {
+		return err
+	}
+	for _, c := range conns {
+		c.sendEncoded(data)
+	}
+	return nil
+}
+
+// Delivers msg to every connection of the user identity, or to their mailbox
+// if they have none.
+func (h *hub) deliverUser(identity string, msg *proto.MsgDeliver) error {
+	seq := h.sequencer(msg.Target)
+	defer h.release(seq)
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+
+	msg.Time = time.Now().UnixNano()
+	msg.Seq = uint(seq.last + 1)
+	data, err := encodeDeliver(msg)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	online := h.users[identity]
+	conns := make([]*conn, 0, len(online))
+	for c := range online {
+		conns = append(conns, c)
+	}
+	if len(conns) == 0 && !h.mail.put(identity, msg) {
+		h.mu.Unlock()
+		return &protocolError{
+			code:    proto.ERR_MAILBOX_FULL,
+			target:  msg.Target,
+			message: "Mailbox is full",
+		}
+	}
+	h.mu.Unlock()
+
+	seq.last++
+	for _, c := range conns {
+		c.sendEncoded(data)
+	}
+	return nil
+}
+
+// Encodes msg once for every recipient of a delivery.
+func encodeDeliver(msg *proto.MsgDeliver) ([]byte, error) {
+	m := proto.Msg(msg)
+	data, err := proto.EncodeMsg(&m)
+	if err != nil {
+		log.Printf("%q: %v", msg.Target, err)
+		return nil, &protocolError{
+			code:    proto.ERR_INTERNAL,
+			target:  msg.Target,
+			message: "Failed to encode message",
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"lotor/proto"
+)
+
+// Measures the cost of delivering one message to a target as its number of
+// members grows. Since the message is encoded once and its bytes are shared,
+// allocations per delivery should not depend on the number of members.
+func BenchmarkDeliver(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("members=%d", n), func(b *testing.B) {
+			benchmarkDeliver(b, n)
+		})
+	}
+}
+
+func benchmarkDeliver(b *testing.B, n int) {
+	srv := &server{queueSize: 256, queuePolicy: dropOldest}
+	h := newHub(nil, newMailboxes(0, 0, 0))
+	target := []byte("bench")
+
+	conns := make([]*conn, n)
+	batches := make([][]outItem, n)
+	for i := range conns {
+		conns[i] = &conn{
+			srv:  srv,
+			name: fmt.Sprintf("member%d", i),
+			out:  newOutQueue(srv.queueSize, srv.queuePolicy),
+		}
+		h.join(conns[i], target)
+	}
+	payload := make([]byte, 256)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := &proto.MsgDeliver{
+			Sender:  "member0",
+			Target:  target,
+			Payload: payload,
+		}
+		err := h.deliver(conns[0], msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		// Stand in for the writer goroutines, which would otherwise
+		// drain the queues.
+		for j, c := range conns {
+			batches[j] = c.out.popAll(batches[j])
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"lotor/proto"
+)
+
+// An idleReader reads from a connection, failing with a timeout once the peer
+// has sent nothing for the given duration.
+type idleReader struct {
+	nc net.Conn
+	// Zero disables the timeout. Owned by the reader goroutine.
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.nc.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	return r.nc.Read(p)
+}
+
+// Changes the timeout, for peers which cannot be pinged. Zero disables it.
+func (r *idleReader) setTimeout(timeout time.Duration) {
+	r.timeout = timeout
+	if timeout == 0 {
+		r.nc.SetReadDeadline(time.Time{})
+	}
+}
+
+// Reports whether err is a connection timing out.
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// Pings the client every pingInterval until the connection closes. Any
+// message from the client, not just MsgPong, keeps the connection alive.
+func (c *conn) pingLoop() {
+	t := time.NewTicker(c.srv.pingInterval)
+	defer t.Stop()
+
+	var nonce uint64
+	for {
+		select {
+		case <-t.C:
+			nonce++
+			c.send(&proto.MsgPing{Nonce: nonce})
+		case <-c.done:
+			return
+		}
+	}
+}
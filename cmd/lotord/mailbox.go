@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"lotor/proto"
+)
+
+// Mailboxes hold messages sent to users while they are offline. Each mailbox
+// holds at most maxSize messages, all mailboxes together hold at most
+// maxBytes bytes of messages, and messages older than maxAge are discarded.
+// It is safe for concurrent use.
+type mailboxes struct {
+	maxSize  int
+	maxBytes int
+	maxAge   time.Duration
+
+	mu    sync.Mutex
+	boxes map[string][]mailItem
+	bytes int
+}
+
+type mailItem struct {
+	msg    *proto.MsgDeliver
+	queued time.Time
+}
+
+func newMailboxes(maxSize, maxBytes int, maxAge time.Duration) *mailboxes {
+	return &mailboxes{
+		maxSize:  maxSize,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		boxes:    make(map[string][]mailItem),
+	}
+}
+
+// Returns the number of bytes msg counts for against maxBytes.
+func mailSize(msg *proto.MsgDeliver) int {
+	return len(msg.Sender) + len(msg.Target) + len(msg.Payload)
+}
+
+// Adds msg to the mailbox of identity. Returns false if the mailbox, or all
+// of them together, are full.
+func (m *mailboxes) put(identity string, msg *proto.MsgDeliver) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	box := m.prune(identity, now)
+	size := mailSize(msg)
+	if len(box) >= m.maxSize || m.bytes+size > m.maxBytes {
+		return false
+	}
+	m.boxes[identity] = append(box, mailItem{msg: msg, queued: now})
+	m.bytes += size
+	return true
+}
+
+// Reports whether the mailbox of identity holds any messages.
+func (m *mailboxes) has(identity string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.boxes[identity]) > 0
+}
+
+// Empties the mailbox of identity, returning the messages it held.
+func (m *mailboxes) take(identity string) []*proto.MsgDeliver {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box := m.prune(identity, time.Now())
+	delete(m.boxes, identity)
+
+	msgs := make([]*proto.MsgDeliver, len(box))
+	for i, item := range box {
+		msgs[i] = item.msg
+		m.bytes -= mailSize(item.msg)
+	}
+	return msgs
+}
+
+// Drops expired messages from the mailbox of identity and returns what is
+// left. Must be called with m.mu held.
+func (m *mailboxes) prune(identity string, now time.Time) []mailItem {
+	box := m.boxes[identity]
+	i := 0
+	for i < len(box) && now.Sub(box[i].queued) > m.maxAge {
+		m.bytes -= mailSize(box[i].msg)
+		i++
+	}
+	box = box[i:]
+	if len(box) == 0 {
+		delete(m.boxes, identity)
+		return nil
+	}
+	m.boxes[identity] = box
+	return box
+}
+
+// Drops expired messages from every mailbox, so that the mailboxes of users
+// who never come back do not grow forever.
+func (m *mailboxes) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for identity := range m.boxes {
+		m.prune(identity, now)
+	}
+}
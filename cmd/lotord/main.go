@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"lotor/frame"
+)
+
+func main() {
+	listen := flag.String("listen", ":7070", "TCP address to listen on, or empty to disable plaintext connections")
+	unixListen := flag.String("unix", "", "path of a Unix socket to listen on")
+	unixUsersFile := flag.String("unix-users", "", "file mapping the UIDs of Unix socket clients to identities (Linux only)")
+	unixMode := flag.String("unix-mode", "0666", "permissions of the Unix socket, in octal; clients need write permission to connect")
+	wsListen := flag.String("ws-listen", "", "TCP address to serve WebSocket connections on")
+	wssListen := flag.String("wss-listen", "", "TCP address to serve WebSocket connections over TLS on")
+	wsOrigins := flag.String("ws-origins", "", "comma-separated origins of the web pages allowed to open WebSocket connections, such as https://chat.example.com")
+	tlsListen := flag.String("tls-listen", "", "TCP address to listen on for TLS connections")
+	tlsCert := flag.String("tls-cert", "", "certificate file for TLS connections, reloaded on SIGHUP")
+	tlsKey := flag.String("tls-key", "", "private key file for TLS connections, reloaded on SIGHUP")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA certificates to verify TLS client certificates with; their common name is the client's identity")
+	maxFrame := flag.Uint64("max-frame", frame.DefaultMaxSize, "maximum frame size in bytes")
+	maxPayload := flag.Int("max-payload", 64*1024, "maximum MsgMsg payload size in bytes")
+	passwords := flag.String("passwords", "", "password file for PLAIN authentication")
+	tokens := flag.String("tokens", "", "bearer token file for token authentication")
+	keys := flag.String("keys", "", "public key registry for ed25519 authentication")
+	historyDir := flag.String("history", "", "directory to store message history in")
+	maxReplay := flag.Int("history-max", 1000, "maximum number of messages replayed per MsgHistory")
+	mailboxSize := flag.Int("mailbox-size", 100, "maximum number of messages kept for an offline user")
+	mailboxBytes := flag.Int("mailbox-bytes", 64*1024*1024, "maximum number of bytes of messages kept for all offline users together")
+	mailboxAge := flag.Duration("mailbox-age", 7*24*time.Hour, "maximum time a message is kept for an offline user")
+	joinRate := flag.Float64("join-rate", 1, "joins allowed per second per identity, or 0 for no limit")
+	joinBurst := flag.Float64("join-burst", 10, "joins allowed in a burst per identity")
+	msgRate := flag.Float64("msg-rate", 10, "messages allowed per second per identity, or 0 for no limit")
+	msgBurst := flag.Float64("msg-burst", 50, "messages allowed in a burst per identity")
+	historyRate := flag.Float64("history-rate", 1, "history requests allowed per second per identity, or 0 for no limit")
+	historyBurst := flag.Float64("history-burst", 10, "history requests allowed in a burst per identity")
+	authRate := flag.Float64("auth-rate", 1, "password attempts allowed per second per remote host, or 0 for no limit")
+	authBurst := flag.Float64("auth-burst", 10, "password attempts allowed in a burst per remote host")
+	authConcurrency := flag.Int("auth-concurrency", runtime.NumCPU(), "maximum number of password checks running at once")
+	rates := flag.String("rates", "", "file of per-identity rate limits")
+	maxStrikes := flag.Int("rate-strikes", 10, "consecutive rate limit violations before disconnecting")
+	queueSize := flag.Int("queue-size", 256, "maximum number of deliveries, and of replies, queued for a client")
+	queuePolicy := flag.String("queue-policy", "drop-oldest", "what to do with a delivery when a client's queue is full: drop-oldest, drop-newest or disconnect")
+	pingInterval := flag.Duration("ping-interval", 30*time.Second, "interval between pings to clients, or 0 to disable pings and idle timeouts")
+	pingTimeout := flag.Duration("ping-timeout", 30*time.Second, "how long a client may stay silent after a ping before it is disconnected")
+	quietTimeout := flag.Duration("quiet-timeout", 10*time.Minute, "how long a client too old to be pinged may stay silent before it is disconnected, or 0 for no limit")
+	captureDir := flag.String("capture", "", "directory to record a capture file of every connection into")
+	mkpasswdFor := flag.String("mkpasswd", "", "print a password file line for this identity, reading the password from standard input, and exit")
+	flag.Parse()
+
+	if *mkpasswdFor != "" {
+		err := mkpasswd(os.Stdout, os.Stdin, *mkpasswdFor)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	policy, err := parseOverflowPolicy(*queuePolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *queueSize < 1 {
+		log.Fatal("-queue-size must be at least 1")
+	}
+	defaultRates := map[string]rate{
+		rateJoin:    {*joinRate, *joinBurst},
+		rateMsg:     {*msgRate, *msgBurst},
+		rateHistory: {*historyRate, *historyBurst},
+	}
+	authRates := map[string]rate{
+		rateAuth: {*authRate, *authBurst},
+	}
+	for _, rates := range []map[string]rate{defaultRates, authRates} {
+		for kind, r := range rates {
+			if r.perSecond < 0 {
+				log.Fatalf("-%s-rate must not be negative", kind)
+			}
+			if r.burst < 1 {
+				log.Fatalf("-%s-burst must be at least 1", kind)
+			}
+		}
+	}
+	if *authConcurrency < 1 {
+		log.Fatal("-auth-concurrency must be at least 1")
+	}
+
+	var auth []authenticator
+	if *passwords != "" {
+		f, err := loadPasswordFile(*passwords)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth = append(auth, f)
+	}
+	if *tokens != "" {
+		f, err := loadTokenFile(*tokens)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth = append(auth, f)
+	}
+	var reg *keyRegistry
+	if *keys != "" {
+		reg, err = loadKeyRegistry(*keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var tlsConfig *tls.Config
+	if *tlsListen != "" || *wssListen != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-tls-listen and -wss-listen require -tls-cert and -tls-key")
+		}
+		files, err := loadTLSFiles(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go files.reloadOnHangup()
+		tlsConfig = files.config()
+	}
+	unixPerm, err := strconv.ParseUint(*unixMode, 8, 32)
+	if err != nil || unixPerm > 0777 {
+		log.Fatalf("bad -unix-mode %q", *unixMode)
+	}
+	var unixUsers map[uint32]string
+	if *unixUsersFile != "" {
+		if !peerCredSupported {
+			log.Fatal("-unix-users is not supported on this platform")
+		}
+		unixUsers, err = loadUnixUsers(*unixUsersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	origins := make(map[string]bool)
+	for _, origin := range strings.Split(*wsOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins[strings.ToLower(origin)] = true
+		}
+	}
+	external := tlsConfig != nil && *tlsClientCA != "" || unixUsers != nil
+
+	if len(auth) == 0 && reg == nil && !external {
+		log.Printf("no authenticators configured, accepting anonymous clients")
+	}
+
+	var hist *history
+	if *historyDir != "" {
+		hist, err = openHistory(*historyDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	limits := newLimiter(defaultRates)
+	if *rates != "" {
+		err := limits.loadOverrides(*rates)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	go limits.sweep(time.Minute)
+	authLimits := newLimiter(authRates)
+	go authLimits.sweep(time.Minute)
+
+	mail := newMailboxes(*mailboxSize, *mailboxBytes, *mailboxAge)
+	h := newHub(hist, mail)
+	go h.sweep(time.Minute)
+
+	srv := &server{
+		maxFrame:     *maxFrame,
+		maxPayload:   *maxPayload,
+		maxReplay:    *maxReplay,
+		hub:          h,
+		limits:       limits,
+		maxStrikes:   *maxStrikes,
+		queueSize:    *queueSize,
+		queuePolicy:  policy,
+		pingInterval: *pingInterval,
+		pingTimeout:  *pingTimeout,
+		quietTimeout: *quietTimeout,
+		auth:         auth,
+		keys:         reg,
+		authLimits:   authLimits,
+		authSlots:    make(chan struct{}, *authConcurrency),
+		external:     external,
+		unixUsers:    unixUsers,
+		wsOrigins:    origins,
+		captureDir:   *captureDir,
+	}
+
+	var serves []func() error
+	if *listen != "" {
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("listening on %s", l.Addr())
+		serves = append(serves, func() error { return srv.serve(l) })
+	}
+	if *tlsListen != "" {
+		l, err := tls.Listen("tcp", *tlsListen, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("listening on %s (TLS)", l.Addr())
+		serves = append(serves, func() error { return srv.serve(l) })
+	}
+	if *unixListen != "" {
+		l, err := listenUnix(*unixListen, os.FileMode(unixPerm))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("listening on %s", l.Addr())
+		serves = append(serves, func() error { return srv.serve(l) })
+	}
+	if *wsListen != "" {
+		l, err := net.Listen("tcp", *wsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("listening on %s (WebSocket)", l.Addr())
+		serves = append(serves, func() error { return srv.websocketServer().Serve(l) })
+	}
+	if *wssListen != "" {
+		l, err := tls.Listen("tcp", *wssListen, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("listening on %s (WebSocket over TLS)", l.Addr())
+		serves = append(serves, func() error { return srv.websocketServer().Serve(l) })
+	}
+	if len(serves) == 0 {
+		log.Fatal("no listeners configured")
+	}
+
+	errs := make(chan error)
+	for _, serve := range serves {
+		go func(serve func() error) {
+			errs <- serve()
+		}(serve)
+	}
+	for range serves {
+		err := <-errs
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
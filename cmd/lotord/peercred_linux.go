@@ -0,0 +1,35 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Whether peerUID can tell who is connecting.
+const peerCredSupported = true
+
+// Returns the UID of the process at the other end of nc, as recorded by the
+// kernel when it connected.
+func peerUID(nc *net.UnixConn) (uint32, error) {
+	raw, err := nc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Whether peerUID can tell who is connecting.
+const peerCredSupported = false
+
+func peerUID(nc *net.UnixConn) (uint32, error) {
+	return 0, errors.New("Peer credentials are not supported on this platform")
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// What a connection's outbound queue does with a message that does not fit.
+type overflowPolicy int
+
+const (
+	dropOldest overflowPolicy = iota
+	dropNewest
+	disconnectSlow
+)
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch s {
+	case "drop-oldest":
+		return dropOldest, nil
+	case "drop-newest":
+		return dropNewest, nil
+	case "disconnect":
+		return disconnectSlow, nil
+	}
+	return 0, fmt.Errorf("Unknown queue policy %q", s)
+}
+
+// An outQueue is the bounded queue of encoded messages waiting for a
+// connection's writer goroutine. Deliveries fanned out to a target never
+// block, so a slow reader cannot stall the delivery of a message to the other
+// members of a target; the overflow policy applies to them only. Replies to
+// the connection's own commands are never dropped: pushing one waits for room
+// instead, which stops reading commands from a client which does not read
+// the replies. Queued messages may be shared with other queues and must not
+// be modified. It is safe for concurrent use.
+type outQueue struct {
+	max    int
+	policy overflowPolicy
+
+	// Receives a value whenever the queue becomes non-empty.
+	wake chan struct{}
+	// Receives a value whenever the writer takes the queued messages.
+	space chan struct{}
+
+	mu    sync.Mutex
+	items []outItem
+	// Number of queued deliveries and replies.
+	deliveries int
+	replies    int
+	dropped    uint64
+}
+
+type outItem struct {
+	data  []byte
+	reply bool
+}
+
+func newOutQueue(max int, policy overflowPolicy) *outQueue {
+	return &outQueue{
+		max:    max,
+		policy: policy,
+		wake:   make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+}
+
+// Appends a delivery to the queue, applying the overflow policy if max
+// deliveries are already queued. Returns false if the policy is to
+// disconnect.
+func (q *outQueue) push(data []byte) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.deliveries >= q.max {
+		switch q.policy {
+		case dropOldest:
+			for i, item := range q.items {
+				if !item.reply {
+					q.items = append(q.items[:i], q.items[i+1:]...)
+					break
+				}
+			}
+			q.deliveries--
+			q.dropped++
+		case dropNewest:
+			q.dropped++
+			return true
+		case disconnectSlow:
+			return false
+		}
+	}
+
+	q.deliveries++
+	q.add(outItem{data: data})
+	return true
+}
+
+// Appends a reply to the queue, waiting while max replies are already
+// queued. Returns false if done is closed first.
+func (q *outQueue) pushReply(data []byte, done <-chan struct{}) bool {
+	for {
+		q.mu.Lock()
+		if q.replies < q.max {
+			q.replies++
+			q.add(outItem{data: data, reply: true})
+			q.mu.Unlock()
+			return true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.space:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// Appends a reply to the queue even if it is full.
+func (q *outQueue) pushForced(data []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.replies++
+	q.add(outItem{data: data, reply: true})
+}
+
+// Must be called with q.mu held.
+func (q *outQueue) add(item outItem) {
+	q.items = append(q.items, item)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Removes and returns every queued message. The queue continues in buf, which
+// should be the slice returned by the previous call once the caller is done
+// with it, so that a busy connection does not allocate a new slice for every
+// batch.
+func (q *outQueue) popAll(buf []outItem) []outItem {
+	for i := range buf {
+		buf[i] = outItem{}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := q.items
+	q.items = buf[:0]
+	q.deliveries = 0
+	q.replies = 0
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+	return items
+}
+
+// Returns the number of messages dropped by the overflow policy.
+func (q *outQueue) droppedCount() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
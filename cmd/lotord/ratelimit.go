@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of commands which are rate limited.
+const (
+	rateJoin    = "join"
+	rateMsg     = "msg"
+	rateHistory = "history"
+	// Password checks, which are limited by remote host rather than by
+	// identity since they happen before there is one.
+	rateAuth = "auth"
+)
+
+// A rate allows burst commands at once, refilled at perSecond commands per
+// second. A zero perSecond means no limit.
+type rate struct {
+	perSecond float64
+	burst     float64
+}
+
+type bucketKey struct {
+	identity string
+	kind     string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A limiter keeps a token bucket for each kind of command of each identity,
+// shared by all connections of that identity. It is safe for concurrent use.
+type limiter struct {
+	defaults  map[string]rate
+	overrides map[bucketKey]rate
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*bucket
+}
+
+func newLimiter(defaults map[string]rate) *limiter {
+	return &limiter{
+		defaults:  defaults,
+		overrides: make(map[bucketKey]rate),
+		buckets:   make(map[bucketKey]*bucket),
+	}
+}
+
+// Loads per-identity rates. Each line of the file holds an identity, a kind
+// of command, a rate per second and a burst size.
+func (l *limiter) loadOverrides(path string) error {
+	lines, err := readFields(path, 4)
+	if err != nil {
+		return err
+	}
+
+	for _, fields := range lines {
+		kind := fields[1]
+		if _, ok := l.defaults[kind]; !ok {
+			return fmt.Errorf("%s: unknown command kind %q", path, kind)
+		}
+		perSecond, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || perSecond < 0 {
+			return fmt.Errorf("%s: bad rate for %s", path, fields[0])
+		}
+		burst, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil || burst < 1 {
+			return fmt.Errorf("%s: bad burst for %s", path, fields[0])
+		}
+		l.overrides[bucketKey{fields[0], kind}] = rate{perSecond, burst}
+	}
+	return nil
+}
+
+func (l *limiter) rate(key bucketKey) rate {
+	if r, ok := l.overrides[key]; ok {
+		return r
+	}
+	return l.defaults[key.kind]
+}
+
+// Takes a token for a command of the given kind by identity. Returns false if
+// its bucket is empty.
+func (l *limiter) allow(identity, kind string) bool {
+	key := bucketKey{identity, kind}
+	r := l.rate(key)
+	if r.perSecond == 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * r.perSecond
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Drops buckets which have refilled completely every interval, since they
+// behave like new ones. Never returns.
+func (l *limiter) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		now := time.Now()
+		for key, b := range l.buckets {
+			r := l.rate(key)
+			if b.tokens+now.Sub(b.last).Seconds()*r.perSecond >= r.burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,882 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lotor/capture"
+	"lotor/frame"
+	"lotor/proto"
+)
+
+// How often a connection whose outbound queue keeps overflowing logs the
+// number of messages dropped.
+const dropReportInterval = 10 * time.Second
+
+// How long the writer keeps trying to deliver a final error before a
+// connection is closed.
+const flushTimeout = 5 * time.Second
+
+type server struct {
+	maxFrame   uint64
+	maxPayload int
+	maxReplay  int
+	hub        *hub
+
+	limits *limiter
+	// Number of consecutive rate limit violations after which a connection
+	// is closed.
+	maxStrikes int
+
+	queueSize   int
+	queuePolicy overflowPolicy
+
+	// Clients are pinged every pingInterval, and disconnected if nothing
+	// arrives from them for pingInterval plus pingTimeout. Zero disables
+	// both.
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	// Clients which predate pings cannot be told apart from dead ones
+	// while they are quiet, so they are given quietTimeout instead, or no
+	// limit if it is zero.
+	quietTimeout time.Duration
+
+	// If none are set, clients are not asked to authenticate and are
+	// identified by their remote address.
+	auth []authenticator
+	keys *keyRegistry
+	// Password checks are expensive and happen before authentication, so
+	// they are limited by remote host, and at most cap(authSlots) of them
+	// run at once.
+	authLimits *limiter
+	authSlots  chan struct{}
+	// Whether clients may log in with the identity established by their
+	// transport, using MsgAuthExternal.
+	external bool
+	// If not nil, identifies clients connecting over a Unix socket by
+	// their UID.
+	unixUsers map[uint32]string
+	// Identities which have logged in with MsgAuthExternal.
+	externalMu   sync.Mutex
+	externalSeen map[string]bool
+	// Origins of the web pages allowed to open WebSocket connections, in
+	// lower case. Requests without an Origin header do not come from a
+	// browser and are always allowed.
+	wsOrigins map[string]bool
+
+	// If set, every connection is recorded into a capture file in this
+	// directory.
+	captureDir string
+
+	// Numbers connections whose remote address does not tell them apart.
+	anonymous uint64 // atomic
+}
+
+// How long a client may stay silent before it is disconnected, or zero for no
+// limit.
+func (s *server) idleTimeout() time.Duration {
+	if s.pingInterval == 0 {
+		return 0
+	}
+	return s.pingInterval + s.pingTimeout
+}
+
+func (s *server) authEnabled() bool {
+	return len(s.auth) > 0 || s.keys != nil || s.external
+}
+
+// Reports whether clients can log in as identity, so that mail is only kept
+// for users who may come to collect it. The identities of TLS client
+// certificates cannot be listed in advance, so those which have logged in
+// since the server started count as well.
+func (s *server) knows(identity string) bool {
+	for _, a := range s.auth {
+		if a.knows(identity) {
+			return true
+		}
+	}
+	if s.keys != nil && s.keys.knows(identity) {
+		return true
+	}
+	for _, id := range s.unixUsers {
+		if id == identity {
+			return true
+		}
+	}
+
+	s.externalMu.Lock()
+	defer s.externalMu.Unlock()
+	return s.externalSeen[identity]
+}
+
+// Returns the capabilities this server can offer in its MsgHello.
+func (s *server) capabilities() []string {
+	caps := []string{proto.CapAcks}
+	if s.hub.history != nil {
+		caps = append(caps, proto.CapHistory)
+	}
+	if s.external {
+		caps = append(caps, proto.CapExternalAuth)
+	}
+	return caps
+}
+
+// Accepts connections from l until it is closed, serving each one on its own
+// pair of goroutines. Temporary accept errors, such as running out of file
+// descriptors, are retried with backoff like net/http does.
+func (s *server) serve(l net.Listener) error {
+	var delay time.Duration
+	for {
+		nc, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay *= 2
+			}
+			if delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("accept: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		} else if err != nil {
+			return err
+		}
+		delay = 0
+
+		c := newConn(s, nc, newStreamTransport)
+		go c.run()
+	}
+}
+
+// Returns the identity established by the transport of nc, or "" if there is
+// none.
+func (s *server) transportIdentity(nc net.Conn) (string, error) {
+	switch nc := nc.(type) {
+	case *tls.Conn:
+		return tlsIdentity(nc)
+	case *net.UnixConn:
+		if s.unixUsers != nil {
+			return unixIdentity(nc, s.unixUsers)
+		}
+	}
+	return "", nil
+}
+
+// Returns the name nc is logged as, which is also its identity on servers
+// without authentication. Unix socket clients are usually unnamed, so they
+// are numbered instead.
+func (s *server) connName(nc net.Conn) string {
+	name := nc.RemoteAddr().String()
+	if name == "" || name == "@" {
+		n := atomic.AddUint64(&s.anonymous, 1)
+		name = fmt.Sprintf("%s#%d", nc.LocalAddr(), n)
+	}
+	return name
+}
+
+// Returns the host part of the remote address of nc, or the whole address if
+// it has none, as for Unix sockets.
+func remoteHost(nc net.Conn) string {
+	addr := nc.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Returned by handlers when a command is rejected. Fatal errors close the
+// connection after the MsgError has been sent.
+type protocolError struct {
+	code    proto.ErrorCode
+	target  []byte
+	message string
+	fatal   bool
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+func (e *protocolError) msg() *proto.MsgError {
+	msg := &proto.MsgError{Code: e.code, Message: e.message}
+	if e.target != nil {
+		msg.Target = &e.target
+	}
+	return msg
+}
+
+// A conn is one client connection. Its reader goroutine decodes incoming
+// messages and dispatches them; its writer goroutine encodes everything
+// queued with send.
+type conn struct {
+	srv  *server
+	nc   net.Conn
+	t    transport
+	name string
+	// The host part of the remote address, which limits password checks.
+	host string
+
+	// Owned by the reader goroutine.
+	idle     *idleReader
+	hello    bool
+	version  uint
+	caps     map[string]bool
+	identity string
+	// The identity established by the transport, if any.
+	external string
+
+	// Consecutive rate limit violations.
+	strikes int
+
+	// Set while an ed25519 challenge is outstanding.
+	challenge         []byte
+	challengeIdentity string
+
+	// Records the connection if captures are enabled.
+	capture *capture.Writer
+
+	out        *outQueue
+	sent       uint64 // atomic
+	flush      chan struct{}
+	flushOnce  sync.Once
+	done       chan struct{}
+	closeOnce  sync.Once
+	writerDone chan struct{}
+
+	// When the number of dropped messages was last logged, in Unix
+	// nanoseconds, and the number logged then.
+	dropLogTime  int64  // atomic
+	dropLogCount uint64 // atomic
+}
+
+func newConn(s *server, nc net.Conn, newTransport newTransport) *conn {
+	idle := &idleReader{nc: nc, timeout: s.idleTimeout()}
+	return &conn{
+		srv:        s,
+		nc:         nc,
+		t:          newTransport(idle, nc, s.maxFrame),
+		name:       s.connName(nc),
+		host:       remoteHost(nc),
+		idle:       idle,
+		out:        newOutQueue(s.queueSize, s.queuePolicy),
+		flush:      make(chan struct{}),
+		done:       make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+}
+
+func (c *conn) run() {
+	external, err := c.srv.transportIdentity(c.nc)
+	if err != nil {
+		log.Printf("%s: %v", c.name, err)
+		c.nc.Close()
+		return
+	}
+	c.external = external
+	if external != "" {
+		log.Printf("%s: connected, transport identity %q", c.name, external)
+	} else {
+		log.Printf("%s: connected", c.name)
+	}
+	if c.srv.captureDir != "" {
+		cw, err := createCapture(c.srv.captureDir, c.name)
+		if err != nil {
+			log.Printf("%s: capture: %v", c.name, err)
+		} else {
+			c.capture = cw
+			c.t = newCapturedTransport(c.t, cw)
+		}
+	}
+	go c.writeLoop()
+
+	err = proto.DecodeRecv(c.t, c.dispatch)
+	if isTimeout(err) {
+		log.Printf("%s: idle timeout", c.name)
+	} else if err != nil {
+		log.Printf("%s: %v", c.name, err)
+	}
+
+	var (
+		perr     *protocolError
+		tooLarge *frame.TooLargeError
+		decode   *proto.DecodeError
+	)
+	switch {
+	case errors.As(err, &perr):
+		c.sendAndClose(perr.msg())
+	case errors.As(err, &tooLarge):
+		c.sendAndClose(&proto.MsgError{Code: proto.ERR_TOO_LARGE, Message: tooLarge.Error()})
+	case errors.As(err, &decode):
+		c.sendAndClose(&proto.MsgError{Code: proto.ERR_MALFORMED, Message: decode.Error()})
+	default:
+		c.close()
+	}
+
+	c.srv.hub.partAll(c)
+	if c.identity != "" {
+		c.srv.hub.logout(c, c.identity)
+	}
+	log.Printf("%s: disconnected (sent %d, dropped %d)", c.name,
+		atomic.LoadUint64(&c.sent), c.out.droppedCount())
+
+	if c.capture != nil {
+		<-c.writerDone
+		err = c.capture.Close()
+		if err != nil {
+			log.Printf("%s: capture: %v", c.name, err)
+		}
+	}
+}
+
+var errHelloRequired = &protocolError{
+	code:    proto.ERR_HELLO_REQUIRED,
+	message: "Expected MsgHello",
+	fatal:   true,
+}
+
+// Dispatches msg to its handler. Non-fatal protocol errors are reported to
+// the client and do not end the connection.
+func (c *conn) dispatch(msg proto.Msg) error {
+	err := c.handle(msg)
+
+	var perr *protocolError
+	if errors.As(err, &perr) && !perr.fatal {
+		c.send(perr.msg())
+		return nil
+	}
+	return err
+}
+
+func (c *conn) handle(msg proto.Msg) error {
+	switch msg.(type) {
+	case *proto.MsgHello:
+	case *proto.MsgPing, *proto.MsgPong,
+		*proto.MsgAuthPlain, *proto.MsgAuthToken, *proto.MsgAuthKey, *proto.MsgAuthSignature,
+		*proto.MsgAuthExternal:
+		if !c.hello {
+			return errHelloRequired
+		}
+	default:
+		if !c.hello {
+			return errHelloRequired
+		}
+		if c.identity == "" {
+			return &protocolError{
+				code:    proto.ERR_AUTH_REQUIRED,
+				message: "Authentication required",
+			}
+		}
+	}
+
+	var err error
+	switch msg := msg.(type) {
+	case *proto.MsgJoin:
+		err = c.checkRate(rateJoin, msg.Target)
+	case *proto.MsgMsg:
+		err = c.checkRate(rateMsg, msg.Target)
+	case *proto.MsgHistory:
+		err = c.checkRate(rateHistory, msg.Target)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch msg := msg.(type) {
+	case *proto.MsgHello:
+		return c.handleHello(msg)
+	case *proto.MsgPing:
+		c.send(&proto.MsgPong{Nonce: msg.Nonce})
+		return nil
+	case *proto.MsgPong:
+		// Receiving it was enough to keep the connection alive.
+		return nil
+	case *proto.MsgAuthPlain, *proto.MsgAuthToken:
+		return c.handleAuth(msg)
+	case *proto.MsgAuthKey:
+		return c.handleAuthKey(msg)
+	case *proto.MsgAuthSignature:
+		return c.handleAuthSignature(msg)
+	case *proto.MsgAuthExternal:
+		return c.handleAuthExternal(msg)
+	case *proto.MsgJoin:
+		return c.handleJoin(msg)
+	case *proto.MsgPart:
+		return c.handlePart(msg)
+	case *proto.MsgMsg:
+		return c.handleMsg(msg)
+	case *proto.MsgHistory:
+		return c.handleHistory(msg)
+	}
+	return &protocolError{
+		code:    proto.ERR_UNEXPECTED,
+		message: fmt.Sprintf("Unexpected message type %T", msg),
+	}
+}
+
+// Checks the rate limit for a command of the given kind about target.
+// Violations are reported to the client until maxStrikes of them happen in a
+// row, at which point the connection is closed. History requests do not count
+// towards the strikes, since client libraries send them by themselves to
+// recover from gaps; they are only rejected.
+func (c *conn) checkRate(kind string, target []byte) error {
+	strike := kind != rateHistory
+	if c.srv.limits.allow(c.identity, kind) {
+		if strike {
+			c.strikes = 0
+		}
+		return nil
+	}
+
+	err := &protocolError{
+		code:    proto.ERR_RATE_LIMITED,
+		target:  target,
+		message: fmt.Sprintf("Rate limit for %s exceeded", kind),
+	}
+	if !strike {
+		return err
+	}
+	c.strikes++
+	if c.strikes >= c.srv.maxStrikes {
+		err.message = "Rate limit exceeded too many times"
+		err.fatal = true
+	}
+	return err
+}
+
+func (c *conn) handleHello(msg *proto.MsgHello) error {
+	if c.hello {
+		return &protocolError{
+			code:    proto.ERR_UNEXPECTED,
+			message: "Handshake already completed",
+		}
+	}
+
+	version, ok := proto.NegotiateVersion(msg.Version)
+	if !ok {
+		return &protocolError{
+			code: proto.ERR_INCOMPATIBLE_VERSION,
+			message: fmt.Sprintf("Protocol version %d is not supported (need %d to %d)",
+				msg.Version, proto.MinVersion, proto.Version),
+			fatal: true,
+		}
+	}
+
+	caps := proto.NegotiateCapabilities(msg.Capabilities, c.srv.capabilities())
+	c.hello = true
+	c.version = version
+	c.caps = make(map[string]bool)
+	for _, cap := range caps {
+		c.caps[cap] = true
+	}
+	log.Printf("%s: hello version %d, capabilities %q", c.name, version, caps)
+	c.send(&proto.MsgHello{Version: version, Capabilities: caps})
+	if c.srv.pingInterval > 0 {
+		if version >= proto.PingVersion {
+			go c.pingLoop()
+		} else {
+			c.idle.setTimeout(c.srv.quietTimeout)
+		}
+	}
+	if !c.srv.authEnabled() {
+		c.login(c.name)
+	}
+	return nil
+}
+
+var errAuthFailed = &protocolError{
+	code:    proto.ERR_AUTH_FAILED,
+	message: "Authentication failed",
+	fatal:   true,
+}
+
+// Checks that an authentication attempt is allowed at this point.
+func (c *conn) checkAuth(enabled bool) error {
+	if !enabled {
+		return &protocolError{
+			code:    proto.ERR_AUTH_FAILED,
+			message: "This authentication method is not enabled on this server",
+		}
+	}
+	if c.identity != "" {
+		return &protocolError{
+			code:    proto.ERR_UNEXPECTED,
+			message: "Already authenticated",
+		}
+	}
+	return nil
+}
+
+func (c *conn) authenticated(identity string) {
+	log.Printf("%s: authenticated as %q", c.name, identity)
+	c.send(&proto.MsgAuthOk{Identity: identity})
+	c.login(identity)
+}
+
+// Sets the identity of c and delivers its mailbox.
+func (c *conn) login(identity string) {
+	c.identity = identity
+	c.srv.hub.login(c, identity)
+}
+
+// Rejects commands which only apply to joinable targets.
+func checkJoinable(target []byte) error {
+	if _, ok := proto.ParseUserTarget(target); ok {
+		return &protocolError{
+			code:    proto.ERR_BAD_TARGET,
+			target:  target,
+			message: "User targets cannot be joined",
+		}
+	}
+	return nil
+}
+
+var errAuthRateLimited = &protocolError{
+	code:    proto.ERR_RATE_LIMITED,
+	message: "Too many authentication attempts",
+	fatal:   true,
+}
+
+func (c *conn) handleAuth(msg proto.Msg) error {
+	err := c.checkAuth(len(c.srv.auth) > 0)
+	if err != nil {
+		return err
+	}
+	if _, ok := msg.(*proto.MsgAuthPlain); ok {
+		if !c.srv.authLimits.allow(c.host, rateAuth) {
+			return errAuthRateLimited
+		}
+		select {
+		case c.srv.authSlots <- struct{}{}:
+			defer func() {
+				<-c.srv.authSlots
+			}()
+		default:
+			return errAuthRateLimited
+		}
+	}
+
+	for _, a := range c.srv.auth {
+		if identity, ok := a.authenticate(msg); ok {
+			c.authenticated(identity)
+			return nil
+		}
+	}
+	return errAuthFailed
+}
+
+// Starts ed25519 authentication. A challenge is issued even for identities
+// without a registered key, so that the reply does not reveal which
+// identities exist. Only one challenge may be outstanding, and a wrong
+// signature closes the connection, so each connection gets a single attempt.
+func (c *conn) handleAuthKey(msg *proto.MsgAuthKey) error {
+	err := c.checkAuth(c.srv.keys != nil)
+	if err != nil {
+		return err
+	}
+	if c.challenge != nil {
+		return &protocolError{
+			code:    proto.ERR_UNEXPECTED,
+			message: "Challenge already outstanding",
+			fatal:   true,
+		}
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	c.challenge = nonce
+	c.challengeIdentity = msg.Identity
+	c.send(&proto.MsgAuthChallenge{Nonce: nonce})
+	return nil
+}
+
+func (c *conn) handleAuthSignature(msg *proto.MsgAuthSignature) error {
+	err := c.checkAuth(c.srv.keys != nil)
+	if err != nil {
+		return err
+	}
+	if c.challenge == nil {
+		return &protocolError{
+			code:    proto.ERR_UNEXPECTED,
+			message: "No challenge outstanding",
+		}
+	}
+
+	nonce, identity := c.challenge, c.challengeIdentity
+	c.challenge, c.challengeIdentity = nil, ""
+	if !c.srv.keys.verify(identity, nonce, msg.Signature) {
+		return errAuthFailed
+	}
+	c.authenticated(identity)
+	return nil
+}
+
+func (c *conn) handleAuthExternal(msg *proto.MsgAuthExternal) error {
+	err := c.checkAuth(c.caps[proto.CapExternalAuth])
+	if err != nil {
+		return err
+	}
+	if c.external == "" {
+		return errAuthFailed
+	}
+	if msg.Identity != nil && *msg.Identity != c.external {
+		return errAuthFailed
+	}
+
+	c.srv.externalMu.Lock()
+	if c.srv.externalSeen == nil {
+		c.srv.externalSeen = make(map[string]bool)
+	}
+	c.srv.externalSeen[c.external] = true
+	c.srv.externalMu.Unlock()
+	c.authenticated(c.external)
+	return nil
+}
+
+func (c *conn) handleJoin(msg *proto.MsgJoin) error {
+	err := checkJoinable(msg.Target)
+	if err != nil {
+		return err
+	}
+	if c.srv.hub.join(c, msg.Target) {
+		log.Printf("%s: joined %q", c.name, msg.Target)
+	}
+	c.send(&proto.MsgJoined{Target: msg.Target})
+	return nil
+}
+
+func (c *conn) handlePart(msg *proto.MsgPart) error {
+	err := checkJoinable(msg.Target)
+	if err != nil {
+		return err
+	}
+	if !c.srv.hub.part(c, msg.Target) {
+		return &protocolError{
+			code:    proto.ERR_NOT_JOINED,
+			target:  msg.Target,
+			message: "Not a member of this target",
+		}
+	}
+	log.Printf("%s: parted %q", c.name, msg.Target)
+	c.send(&proto.MsgParted{Target: msg.Target, Reason: msg.Reason})
+	return nil
+}
+
+func (c *conn) handleMsg(msg *proto.MsgMsg) error {
+	if len(msg.Payload) > c.srv.maxPayload {
+		return &protocolError{
+			code:    proto.ERR_TOO_LARGE,
+			target:  msg.Target,
+			message: fmt.Sprintf("Payload size %d exceeds limit of %d", len(msg.Payload), c.srv.maxPayload),
+		}
+	}
+
+	deliver := &proto.MsgDeliver{
+		Sender:  c.identity,
+		Target:  msg.Target,
+		Payload: msg.Payload,
+	}
+	var err error
+	if identity, ok := proto.ParseUserTarget(msg.Target); ok {
+		if c.srv.authEnabled() && !c.srv.knows(identity) {
+			return &protocolError{
+				code:    proto.ERR_UNKNOWN_TARGET,
+				target:  msg.Target,
+				message: "No such user",
+			}
+		}
+		err = c.srv.hub.deliverUser(identity, deliver)
+	} else {
+		err = c.srv.hub.deliver(c, deliver)
+	}
+	if err != nil {
+		return err
+	}
+	if c.caps[proto.CapAcks] {
+		c.send(&proto.MsgAck{Target: msg.Target, Seq: deliver.Seq})
+	}
+	return nil
+}
+
+func (c *conn) handleHistory(msg *proto.MsgHistory) error {
+	err := checkJoinable(msg.Target)
+	if err != nil {
+		return err
+	}
+	if c.srv.hub.history == nil {
+		return &protocolError{
+			code:    proto.ERR_NO_HISTORY,
+			target:  msg.Target,
+			message: "History is not enabled on this server",
+		}
+	}
+	if !c.srv.hub.isMember(c, msg.Target) {
+		return &protocolError{
+			code:    proto.ERR_NOT_JOINED,
+			target:  msg.Target,
+			message: "Not a member of this target",
+		}
+	}
+
+	records, err := c.srv.hub.history.replay(msg.Target, msg.Since, msg.Count, c.srv.maxReplay)
+	if err != nil {
+		log.Printf("history: %q: %v", msg.Target, err)
+		return &protocolError{
+			code:    proto.ERR_INTERNAL,
+			target:  msg.Target,
+			message: "Failed to read history",
+		}
+	}
+	for _, rec := range records {
+		c.send(&proto.MsgDeliver{
+			Sender:  rec.Sender,
+			Target:  msg.Target,
+			Seq:     uint(rec.Seq),
+			Time:    rec.Time,
+			Payload: rec.Payload,
+		})
+	}
+	c.send(&proto.MsgHistoryEnd{Target: msg.Target})
+	return nil
+}
+
+// Queues msg, a reply to the connection or a message replayed for it, for
+// the writer goroutine, waiting for room in the queue if it is full.
+// Messages sent after the connection has closed are discarded.
+func (c *conn) send(msg proto.Msg) {
+	data, err := proto.EncodeMsg(&msg)
+	if err != nil {
+		log.Printf("%s: %v", c.name, err)
+		c.close()
+		return
+	}
+	c.out.pushReply(data, c.done)
+}
+
+// Queues a delivery that has already been encoded because it is being fanned
+// out to every member of a target. It is subject to the overflow policy of
+// the queue. data is not copied and must not be modified afterwards.
+func (c *conn) sendEncoded(data []byte) {
+	if !c.out.push(data) {
+		log.Printf("%s: outbound queue full, disconnecting", c.name)
+		c.close()
+		return
+	}
+	c.logDrops()
+}
+
+// Logs the number of messages dropped by the overflow policy so far if it
+// has grown, at most once every dropReportInterval, so that a client which
+// keeps falling behind shows up in the log while it is still connected.
+func (c *conn) logDrops() {
+	dropped := c.out.droppedCount()
+	if dropped == atomic.LoadUint64(&c.dropLogCount) {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&c.dropLogTime)
+	if last != 0 && now-last < int64(dropReportInterval) {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&c.dropLogTime, last, now) {
+		return
+	}
+	atomic.StoreUint64(&c.dropLogCount, dropped)
+	log.Printf("%s: outbound queue full, dropped %d messages so far", c.name, dropped)
+}
+
+// Queues msg even if the queue is full, without waiting for room. Callers
+// bound the number of messages queued this way themselves.
+func (c *conn) sendForced(msg proto.Msg) {
+	data, err := proto.EncodeMsg(&msg)
+	if err != nil {
+		log.Printf("%s: %v", c.name, err)
+		c.close()
+		return
+	}
+	c.out.pushForced(data)
+}
+
+// Queues msg and closes the connection once the writer has flushed it along
+// with everything queued before it. The message is queued even if the queue
+// is full.
+func (c *conn) sendAndClose(msg proto.Msg) {
+	c.sendForced(msg)
+	c.flushOnce.Do(func() {
+		close(c.flush)
+	})
+}
+
+func (c *conn) writeLoop() {
+	defer close(c.writerDone)
+
+	var batch []outItem
+	writeAll := func() bool {
+		batch = c.out.popAll(batch)
+		for _, item := range batch {
+			err := c.t.WriteFrame(item.data)
+			if err != nil {
+				log.Printf("%s: %v", c.name, err)
+				c.close()
+				return false
+			}
+			atomic.AddUint64(&c.sent, 1)
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-c.out.wake:
+			if timeout := c.srv.idleTimeout(); timeout > 0 {
+				c.nc.SetWriteDeadline(time.Now().Add(timeout))
+			}
+			if !writeAll() {
+				return
+			}
+		case <-c.flush:
+			c.nc.SetWriteDeadline(time.Now().Add(flushTimeout))
+			if writeAll() {
+				if c.t.closeWrite() == nil {
+					c.linger()
+				}
+				c.close()
+			}
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Half-closes the connection and discards whatever the client still sends
+// for a while. Closing a socket with unread input resets the connection,
+// which can destroy the final messages before the client reads them.
+func (c *conn) linger() {
+	cw, ok := c.nc.(interface{ CloseWrite() error })
+	if !ok || cw.CloseWrite() != nil {
+		return
+	}
+	c.nc.SetReadDeadline(time.Now().Add(flushTimeout))
+	io.Copy(io.Discard, c.nc)
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.nc.Close()
+	})
+}
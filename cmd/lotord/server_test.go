@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"lotor/capture"
+	"lotor/client"
+	"lotor/faultnet"
+	"lotor/proto"
+)
+
+func TestFanOut(t *testing.T) {
+	h := newHarness(t)
+	clients := h.dialN(3)
+	for _, c := range clients {
+		c.join("room")
+	}
+
+	clients[0].send("room", "hello")
+	d := clients[0].expectDeliver("pipe1", "room", "hello")
+	if seq := clients[0].expectAck("room"); seq != d.Seq {
+		t.Errorf("ack has sequence number %d, delivery has %d", seq, d.Seq)
+	}
+	for _, c := range clients[1:] {
+		if got := c.expectDeliver("pipe1", "room", "hello"); got.Seq != d.Seq {
+			t.Errorf("members saw sequence numbers %d and %d", d.Seq, got.Seq)
+		}
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	h := newHarness(t)
+	c := h.dial(client.WithCapabilities())
+	c.join("room")
+
+	for i := uint(1); i <= 3; i++ {
+		c.send("room", "x")
+		if d := c.expectDeliver("pipe1", "room", "x"); d.Seq != i {
+			t.Fatalf("expected sequence number %d, got %d", i, d.Seq)
+		}
+	}
+}
+
+func TestPart(t *testing.T) {
+	h := newHarness(t)
+	clients := h.dialN(2, client.WithCapabilities())
+	for _, c := range clients {
+		c.join("room")
+	}
+
+	err := clients[1].Part([]byte("room"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := clients[1].recv().(*proto.MsgParted); !ok {
+		t.Fatal("expected MsgParted")
+	}
+
+	clients[0].send("room", "anyone?")
+	clients[0].expectDeliver("pipe1", "room", "anyone?")
+	clients[1].expectNothing(100 * time.Millisecond)
+}
+
+func TestSendWithoutJoin(t *testing.T) {
+	h := newHarness(t)
+	clients := h.dialN(2)
+
+	clients[0].send("room", "hello")
+	clients[0].expectError(proto.ERR_UNKNOWN_TARGET)
+
+	clients[1].join("room")
+	clients[0].send("room", "hello")
+	clients[0].expectError(proto.ERR_NOT_JOINED)
+	clients[1].expectNothing(100 * time.Millisecond)
+}
+
+func TestHelloRequired(t *testing.T) {
+	h := newHarness(t)
+	r, w := h.dialRaw()
+
+	err := proto.EncodeSend(w, proto.MsgJoin{Target: []byte("room")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := r.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg proto.Msg
+	err = proto.DecodeMsg(data, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := msg.(*proto.MsgError); !ok || e.Code != proto.ERR_HELLO_REQUIRED {
+		t.Fatalf("expected ERR_HELLO_REQUIRED, got %T %+v", msg, msg)
+	}
+	if _, err := r.ReadFrame(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+// Lengths beyond the end of the frame and bytes after the message are both
+// malformed, and must be rejected before allocating for them.
+func TestMalformed(t *testing.T) {
+	var msg proto.Msg = &proto.MsgHello{Version: proto.Version}
+	hello, err := proto.EncodeMsg(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := [][]byte{
+		{0, 0x80, 0x80, 0x80, 0x0f},
+		append(hello, 0),
+	}
+
+	h := newHarness(t)
+	for _, body := range bodies {
+		r, w := h.dialRaw()
+		err := w.WriteFrame(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := r.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg proto.Msg
+		err = proto.DecodeMsg(data, &msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := msg.(*proto.MsgError); !ok || e.Code != proto.ERR_MALFORMED {
+			t.Fatalf("%x: expected ERR_MALFORMED, got %T %+v", body, msg, msg)
+		}
+	}
+}
+
+// A flakyListener fails its first accepts with a temporary error.
+type flakyListener struct {
+	*pipeListener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, syscall.EMFILE
+	}
+	return l.pipeListener.Accept()
+}
+
+func TestAcceptRetries(t *testing.T) {
+	h := newHarness(t)
+	l := &flakyListener{pipeListener: newPipeListener(), failures: 3}
+	defer l.Close()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- h.srv.serve(l)
+	}()
+
+	conns := make(chan net.Conn, 1)
+	go func() {
+		nc, err := l.Dial()
+		if err == nil {
+			conns <- nc
+		}
+	}()
+	select {
+	case err := <-errs:
+		t.Fatalf("serve returned %v", err)
+	case nc := <-conns:
+		nc.Close()
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	h := newHarness(t, withTokens(map[string]string{"alice": "secret"}))
+
+	anon := h.dial()
+	err := anon.Join([]byte("room"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anon.expectError(proto.ERR_AUTH_REQUIRED)
+
+	alice := h.dial(client.WithToken("secret"))
+	if alice.Identity() != "alice" {
+		t.Fatalf("authenticated as %q", alice.Identity())
+	}
+	alice.join("room")
+}
+
+func TestAuthRateLimited(t *testing.T) {
+	salt := make([]byte, saltSize)
+	passwords := &passwordFile{
+		entries: map[string]passwordEntry{
+			"alice": {iterations: 1, salt: salt, hash: hashPassword(salt, 1, "hunter2")},
+		},
+		dummy: passwordEntry{iterations: 1, salt: salt, hash: make([]byte, sha256.Size)},
+	}
+	h := newHarness(t, func(h *harness) {
+		h.srv.auth = append(h.srv.auth, passwords)
+		h.srv.authLimits = newLimiter(map[string]rate{rateAuth: {0.1, 1}})
+	})
+
+	// The first attempt from pipe1 is allowed, its second is not, and
+	// pipe2 has attempts of its own.
+	h.srv.authLimits.allow("pipe1", rateAuth)
+	for _, want := range []proto.ErrorCode{proto.ERR_RATE_LIMITED, 0} {
+		nc, err := h.l.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := client.NewConn(nc, client.WithPassword("alice", "hunter2"))
+		if want == 0 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+		} else if e, ok := err.(*client.Error); !ok || e.Code != want {
+			t.Fatalf("expected %s, got %v", want, err)
+		}
+	}
+
+	// Attempts beyond the number of checks which may run at once are
+	// rejected rather than queued.
+	for i := 0; i < cap(h.srv.authSlots); i++ {
+		h.srv.authSlots <- struct{}{}
+	}
+	nc, err := h.l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.NewConn(nc, client.WithPassword("alice", "hunter2"))
+	if e, ok := err.(*client.Error); !ok || e.Code != proto.ERR_RATE_LIMITED {
+		t.Fatalf("expected ERR_RATE_LIMITED, got %v", err)
+	}
+}
+
+// Client captures must not hold the credentials the client logged in with.
+func TestCaptureRedacts(t *testing.T) {
+	h := newHarness(t, withTokens(map[string]string{"alice": "secret"}))
+
+	var buf bytes.Buffer
+	cw, err := capture.NewWriter(&buf, capture.CLIENT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := h.dial(client.WithToken("secret"), client.WithCapture(cw))
+	alice.join("room")
+	err = cw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Fatal("the capture holds the token")
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	h := newHarness(t, withTokens(map[string]string{
+		"alice": "a",
+		"bob":   "b",
+	}))
+	alice := h.dial(client.WithToken("a"))
+
+	alice.send("@bob", "while you were out")
+	alice.expectAck("@bob")
+
+	bob := h.dial(client.WithToken("b"))
+	bob.expectDeliver("alice", "@bob", "while you were out")
+
+	alice.send("@bob", "now")
+	alice.expectAck("@bob")
+	bob.expectDeliver("alice", "@bob", "now")
+}
+
+func TestMailboxUnknownUser(t *testing.T) {
+	h := newHarness(t, withTokens(map[string]string{"alice": "a"}))
+	alice := h.dial(client.WithToken("a"))
+
+	alice.send("@mallory", "hello?")
+	alice.expectError(proto.ERR_UNKNOWN_TARGET)
+}
+
+func TestHistory(t *testing.T) {
+	h := newHarness(t, withHistory)
+	sender := h.dial(client.WithCapabilities())
+	sender.join("room")
+	for _, payload := range []string{"one", "two", "three"} {
+		sender.send("room", payload)
+		sender.expectDeliver("pipe1", "room", payload)
+	}
+
+	late := h.dial(client.WithCapabilities(proto.CapHistory))
+	late.join("room")
+	err := late.HistoryLast([]byte("room"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	late.expectDeliver("pipe1", "room", "two")
+	late.expectDeliver("pipe1", "room", "three")
+	if _, ok := late.recv().(*proto.MsgHistoryEnd); !ok {
+		t.Fatal("expected MsgHistoryEnd")
+	}
+}
+
+func TestHistoryRateLimited(t *testing.T) {
+	h := newHarness(t, withHistory, func(h *harness) {
+		h.srv.limits = newLimiter(map[string]rate{rateHistory: {0.1, 1}})
+		h.srv.maxStrikes = 1
+	})
+	c := h.dial(client.WithCapabilities(proto.CapHistory))
+	c.join("room")
+	for i := 0; i < 2; i++ {
+		err := c.HistoryLast([]byte("room"), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := c.recv().(*proto.MsgHistoryEnd); !ok {
+		t.Fatal("expected MsgHistoryEnd")
+	}
+	c.expectError(proto.ERR_RATE_LIMITED)
+
+	// History requests are not strikes.
+	c.join("other")
+}
+
+// A member which stops reading loses deliveries to its full queue, and the
+// client library recovers them from the history. Each replay is shorter than
+// the gap, so recovering it takes several requests.
+func TestGapRecovery(t *testing.T) {
+	testGapRecovery(t, func(h *harness) {
+		h.srv.maxReplay = 10
+	})
+}
+
+// Recovery requests which are rate limited are sent again later, and do not
+// get the member disconnected. The errors they get are not passed on to the
+// application, which did not make them.
+func TestGapRecoveryRateLimited(t *testing.T) {
+	testGapRecovery(t, func(h *harness) {
+		h.srv.maxReplay = 100
+		h.srv.limits = newLimiter(map[string]rate{rateHistory: {2, 1}})
+		h.srv.maxStrikes = 1
+	})
+}
+
+func testGapRecovery(t *testing.T, configure func(*harness)) {
+	h := newHarness(t, withHistory, func(h *harness) {
+		h.srv.queueSize = 4
+	}, configure)
+	sender := h.dial(client.WithCapabilities())
+	sender.join("room")
+	member, sc := h.dialStallable()
+	member.join("room")
+
+	sender.send("room", "first")
+	sender.expectDeliver("pipe1", "room", "first")
+	member.expectDeliver("pipe1", "room", "first")
+
+	// Joining again while already a member must not reset the tracking of
+	// sequence numbers. The read in progress when the member stalls takes
+	// the confirmation, and the server then waits to write the confirmation
+	// of another join, so that the first delivery read afterwards is one
+	// after the gap.
+	sc.stall()
+	for _, target := range []string{"room", "other"} {
+		err := member.Join([]byte(target))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		sender.send("room", fmt.Sprint(i))
+		sender.expectDeliver("pipe1", "room", fmt.Sprint(i))
+	}
+	sc.resume()
+
+	seen := map[uint]bool{1: true}
+	for len(seen) < n+1 {
+		switch msg := member.recv().(type) {
+		case *proto.MsgDeliver:
+			seen[msg.Seq] = true
+		case *proto.MsgError:
+			t.Fatalf("unexpected error %v: %s", msg.Code, msg.Message)
+		}
+	}
+}
+
+// Members which stop reading lose deliveries according to the overflow
+// policy of their queue.
+func TestQueueDropOldest(t *testing.T) {
+	const n = 20
+	seqs, err := stalledDeliveries(t, dropOldest, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) >= n || len(seqs) < 4 {
+		t.Fatalf("received %v", seqs)
+	}
+	for i, seq := range seqs[len(seqs)-4:] {
+		if seq != uint(n-3+i) {
+			t.Fatalf("expected the newest deliveries to be kept, received %v", seqs)
+		}
+	}
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	const n = 20
+	seqs, err := stalledDeliveries(t, dropNewest, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) >= n {
+		t.Fatalf("received %v", seqs)
+	}
+	for i, seq := range seqs {
+		if seq != uint(i+1) {
+			t.Fatalf("expected the oldest deliveries to be kept, received %v", seqs)
+		}
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	const n = 20
+	seqs, err := stalledDeliveries(t, disconnectSlow, n)
+	if err != client.ErrServerClosed {
+		t.Fatalf("expected the connection to be closed, got %v after receiving %v", err, seqs)
+	}
+	if len(seqs) >= n {
+		t.Fatalf("received %v", seqs)
+	}
+}
+
+// Sends n messages to a member which does not read, with a queue of four
+// deliveries, and returns the sequence numbers it receives once it reads
+// again, along with the error that ended the connection, if any.
+func stalledDeliveries(t *testing.T, policy overflowPolicy, n int) ([]uint, error) {
+	h := newHarness(t, func(h *harness) {
+		h.srv.queueSize = 4
+		h.srv.queuePolicy = policy
+	})
+	sender := h.dial(client.WithCapabilities())
+	sender.join("room")
+	member, sc := h.dialStallable(client.WithCapabilities())
+	member.join("room")
+
+	sc.stall()
+	for i := 0; i < n; i++ {
+		sender.send("room", fmt.Sprint(i))
+		sender.expectDeliver("pipe1", "room", fmt.Sprint(i))
+	}
+	sc.resume()
+
+	var seqs []uint
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		msg, err := member.Recv(ctx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			return seqs, nil
+		} else if err != nil {
+			return seqs, err
+		}
+		if d, ok := msg.(*proto.MsgDeliver); ok {
+			seqs = append(seqs, d.Seq)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	h := newHarness(t, func(h *harness) {
+		h.srv.limits = newLimiter(map[string]rate{
+			rateJoin: {0.1, 1},
+			rateMsg:  {0.1, 2},
+		})
+		h.srv.maxStrikes = 3
+	})
+	c := h.dial(client.WithCapabilities(proto.CapAcks))
+	c.join("room")
+	err := c.Join([]byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := c.expectError(proto.ERR_RATE_LIMITED); e.Target == nil || string(*e.Target) != "other" {
+		t.Fatalf("expected the error to be about %q, got %+v", "other", e)
+	}
+
+	// An allowed command ends the run of strikes, so the connection is
+	// only closed after maxStrikes violations in a row.
+	for _, payload := range []string{"one", "two"} {
+		c.send("room", payload)
+		c.expectDeliver("pipe1", "room", payload)
+		c.expectAck("room")
+	}
+	for i := 0; i < h.srv.maxStrikes; i++ {
+		c.send("room", "three")
+		c.expectError(proto.ERR_RATE_LIMITED)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), recvTimeout)
+	defer cancel()
+	if msg, err := c.Recv(ctx); err != client.ErrServerClosed {
+		t.Fatalf("expected the connection to be closed, got %T %+v, %v", msg, msg, err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	h := newHarness(t)
+	c := h.dial()
+
+	ctx, cancel := context.WithTimeout(context.Background(), recvTimeout)
+	defer cancel()
+	_, err := c.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RTT() == 0 {
+		t.Error("RTT was not recorded")
+	}
+}
+
+// Clients too old to be pinged are disconnected after the longer quiet
+// timeout rather than kept forever.
+func TestQuietTimeout(t *testing.T) {
+	h := newHarness(t, func(h *harness) {
+		h.srv.pingInterval = 10 * time.Millisecond
+		h.srv.pingTimeout = 10 * time.Millisecond
+		h.srv.quietTimeout = 200 * time.Millisecond
+	})
+	r, w := h.dialRaw()
+	err := proto.EncodeSend(w, proto.MsgHello{Version: proto.PingVersion - 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = r.ReadFrame()
+	if err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if d := time.Since(start); d < h.srv.quietTimeout/2 || d > recvTimeout {
+		t.Fatalf("connection closed after %v, expected about %v", d, h.srv.quietTimeout)
+	}
+}
+
+// Pings are answered while the application is not calling Recv, however many
+// messages are waiting for it.
+func TestPingWhileBusy(t *testing.T) {
+	h := newHarness(t, func(h *harness) {
+		h.srv.pingInterval = 20 * time.Millisecond
+		h.srv.pingTimeout = 20 * time.Millisecond
+	})
+	sender := h.dial(client.WithCapabilities())
+	sender.join("room")
+	busy := h.dial(client.WithCapabilities())
+	busy.join("room")
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		sender.send("room", fmt.Sprint(i))
+		sender.expectDeliver("pipe1", "room", fmt.Sprint(i))
+	}
+	time.Sleep(10 * h.srv.idleTimeout())
+	for i := 0; i < n; i++ {
+		busy.expectDeliver("pipe1", "room", fmt.Sprint(i))
+	}
+	busy.join("other")
+}
+
+// Deliveries which do not fit in the buffer of an application which is not
+// calling Recv are dropped by the client library, and recovered from the
+// history once it calls Recv again. Without history, they are lost.
+func TestRecvBuffer(t *testing.T) {
+	for _, history := range []bool{true, false} {
+		t.Run(fmt.Sprintf("history=%v", history), func(t *testing.T) {
+			h := newHarness(t, func(h *harness) {
+				if history {
+					withHistory(h)
+				}
+			})
+			sender := h.dial(client.WithCapabilities())
+			sender.join("room")
+			busy := h.dial(client.WithRecvBuffer(8))
+			busy.join("room")
+			sender.send("room", "first")
+			sender.expectDeliver("pipe1", "room", "first")
+			busy.expectDeliver("pipe1", "room", "first")
+
+			const n = 100
+			for i := 0; i < n; i++ {
+				sender.send("room", fmt.Sprint(i))
+				sender.expectDeliver("pipe1", "room", fmt.Sprint(i))
+			}
+			// Wait for the client library to read everything.
+			ctx, cancel := context.WithTimeout(context.Background(), recvTimeout)
+			defer cancel()
+			_, err := busy.Ping(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			seen := map[uint]bool{1: true}
+			replayed := false
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				msg, err := busy.Recv(ctx)
+				cancel()
+				if err == context.DeadlineExceeded {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				switch msg := msg.(type) {
+				case *proto.MsgDeliver:
+					seen[msg.Seq] = true
+				case *proto.MsgHistoryEnd:
+					replayed = true
+				}
+			}
+			if history && (len(seen) != n+1 || !replayed) {
+				t.Fatalf("received %d deliveries, replayed %v", len(seen), replayed)
+			} else if !history && len(seen) > 8+1 {
+				t.Fatalf("received %d deliveries with a buffer of 8", len(seen))
+			}
+		})
+	}
+}
+
+func TestSlowFragmentedTransport(t *testing.T) {
+	h := newHarness(t, withFaults(faultnet.Config{
+		Seed:         1,
+		Latency:      time.Millisecond,
+		PartialWrite: 0.5,
+	}))
+	clients := h.dialN(2)
+	for _, c := range clients {
+		c.join("room")
+	}
+
+	for _, payload := range []string{"one", "two", "three", strings.Repeat("x", 10000)} {
+		clients[0].send("room", payload)
+		clients[0].expectDeliver("pipe1", "room", payload)
+		clients[0].expectAck("room")
+		clients[1].expectDeliver("pipe1", "room", payload)
+	}
+}
+
+func TestHistoryLargerThanQueue(t *testing.T) {
+	h := newHarness(t, withHistory)
+	n := 2 * h.srv.queueSize
+	sender := h.dial(client.WithCapabilities())
+	sender.join("room")
+	for i := 0; i < n; i++ {
+		sender.send("room", fmt.Sprint(i))
+		sender.expectDeliver("pipe1", "room", fmt.Sprint(i))
+	}
+
+	late := h.dial(client.WithCapabilities(proto.CapHistory))
+	late.join("room")
+	err := late.HistoryLast([]byte("room"), uint(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		late.expectDeliver("pipe1", "room", fmt.Sprint(i))
+	}
+	if _, ok := late.recv().(*proto.MsgHistoryEnd); !ok {
+		t.Fatal("expected MsgHistoryEnd")
+	}
+}
+
+func TestExternalAuthCapability(t *testing.T) {
+	h := newHarness(t)
+	nc, err := h.l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.NewConn(nc, client.WithExternalAuth(""))
+	if err != client.ErrNoExternalAuth {
+		t.Fatalf("expected ErrNoExternalAuth, got %v", err)
+	}
+
+	// Pipes establish no identity, so the server offers external
+	// authentication but rejects it.
+	h = newHarness(t, func(h *harness) {
+		h.srv.external = true
+	})
+	nc, err = h.l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.NewConn(nc, client.WithExternalAuth(""))
+	if e, ok := err.(*client.Error); !ok || e.Code != proto.ERR_AUTH_FAILED {
+		t.Fatalf("expected ERR_AUTH_FAILED, got %v", err)
+	}
+}
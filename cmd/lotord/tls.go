@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long a client may take to complete the TLS handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Holds the certificate and client CAs of the TLS listener, which can be
+// reloaded from their files while the server is running. Connections
+// accepted after a reload use the new files; established ones are not
+// affected.
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	// If set, clients may present a certificate signed by one of these CAs
+	// to authenticate with MsgAuthExternal.
+	clientCAFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+func loadTLSFiles(certFile, keyFile, clientCAFile string) (*tlsFiles, error) {
+	f := &tlsFiles{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reads the files again, keeping the previous ones if any of them fails to
+// load.
+func (f *tlsFiles) load() error {
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if f.clientCAFile != "" {
+		pem, err := os.ReadFile(f.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", f.clientCAFile)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cert = &cert
+	f.clientCA = pool
+	return nil
+}
+
+// Reloads the files whenever the process receives SIGHUP.
+func (f *tlsFiles) reloadOnHangup() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := f.load()
+		if err != nil {
+			log.Printf("tls: reload failed, keeping previous certificates: %v", err)
+			continue
+		}
+		log.Printf("tls: reloaded certificates")
+	}
+}
+
+// Returns the configuration for the TLS listener. Client certificates are
+// requested but optional, since clients may also authenticate by other means.
+func (f *tlsFiles) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			f.mu.RLock()
+			defer f.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*f.cert},
+			}
+			if f.clientCA != nil {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				config.ClientCAs = f.clientCA
+			}
+			return config, nil
+		},
+	}
+}
+
+// Completes the TLS handshake on nc and returns the identity of the client
+// certificate, which is its subject common name, or "" if the client did
+// not present one.
+func tlsIdentity(nc *tls.Conn) (string, error) {
+	nc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer nc.SetDeadline(time.Time{})
+
+	err := nc.Handshake()
+	if err != nil {
+		return "", err
+	}
+
+	state := nc.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return "", errors.New("Client certificate has no common name")
+	}
+	return name, nil
+}
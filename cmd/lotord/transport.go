@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+
+	"lotor/frame"
+)
+
+// A transport carries frames between the server and one client. ReadFrame is
+// only called by the connection's reader goroutine, and WriteFrame and
+// closeWrite only by its writer goroutine.
+type transport interface {
+	frame.ReadFramer
+	frame.WriteFramer
+
+	// Tells the client that nothing more will be written, before the
+	// connection is half-closed.
+	closeWrite() error
+}
+
+// Creates the transport of a connection, reading from r and writing to w.
+// Frames are at most max bytes.
+type newTransport func(r io.Reader, w io.Writer, max uint64) transport
+
+// A streamTransport sends frames over a byte stream, such as a TCP
+// connection, each with a length prefix.
+type streamTransport struct {
+	*frame.Reader
+	*frame.Writer
+}
+
+func newStreamTransport(r io.Reader, w io.Writer, max uint64) transport {
+	return &streamTransport{frame.NewReader(r, max), frame.NewWriter(w, max)}
+}
+
+func (t *streamTransport) closeWrite() error {
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Maps the UIDs of processes connecting over the Unix socket to identities.
+// Each line of the file holds an identity and a UID.
+func loadUnixUsers(path string) (map[uint32]string, error) {
+	lines, err := readFields(path, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[uint32]string)
+	for _, fields := range lines {
+		uid, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad UID for %s: %v", path, fields[0], err)
+		}
+		users[uint32(uid)] = fields[0]
+	}
+	return users, nil
+}
+
+// Listens on the Unix socket at path, replacing a stale socket left behind by
+// a previous run. Connecting to the socket requires write permission on it,
+// so its mode is set to mode regardless of the umask.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	fi, err := os.Lstat(path)
+	if err == nil && fi.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Returns the identity mapped to the UID of the process at the other end of
+// nc, or "" if there is none.
+func unixIdentity(nc *net.UnixConn, users map[uint32]string) (string, error) {
+	uid, err := peerUID(nc)
+	if err != nil {
+		return "", err
+	}
+	return users[uid], nil
+}
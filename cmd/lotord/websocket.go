@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"lotor/frame"
+)
+
+// Appended to the client's key to compute Sec-WebSocket-Accept, as specified
+// by RFC 6455.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The subprotocol name clients may ask for in Sec-WebSocket-Protocol.
+const wsProtocol = "lotor"
+
+// How long a client may take to send its upgrade request.
+const wsHandshakeTimeout = 10 * time.Second
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Close status codes sent in close frames.
+const (
+	wsStatusNormal   = 1000
+	wsStatusProtocol = 1002
+)
+
+// Returned when a client breaks the WebSocket protocol.
+type wsError struct {
+	message string
+}
+
+func (e *wsError) Error() string {
+	return "WebSocket: " + e.message
+}
+
+// Returns an HTTP server which serves the lotor protocol over WebSocket with
+// websocketHandler.
+func (s *server) websocketServer() *http.Server {
+	return &http.Server{
+		Handler:           s.websocketHandler(),
+		ReadHeaderTimeout: wsHandshakeTimeout,
+		ReadTimeout:       wsHandshakeTimeout,
+		WriteTimeout:      wsHandshakeTimeout,
+		IdleTimeout:       wsHandshakeTimeout,
+	}
+}
+
+// Returns an HTTP handler which upgrades every request to a WebSocket and
+// serves the lotor protocol over it. Each binary WebSocket message carries
+// exactly one Msg, without a length prefix.
+//
+// Browsers let any web page open a WebSocket, sending the user's cookies and
+// client certificate along, so requests from pages whose origin is not
+// allowed are rejected.
+func (s *server) websocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := checkUpgrade(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !s.wsOrigins[strings.ToLower(origin)] {
+			log.Printf("websocket: %s: origin %q not allowed", r.RemoteAddr, origin)
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Connection cannot be upgraded", http.StatusInternalServerError)
+			return
+		}
+
+		nc, rw, err := hj.Hijack()
+		if err != nil {
+			log.Printf("websocket: %v", err)
+			return
+		}
+		nc.SetDeadline(time.Time{})
+
+		accept := sha1.Sum([]byte(key + wsGUID))
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n",
+			base64.StdEncoding.EncodeToString(accept[:]))
+		if hasToken(r.Header, "Sec-WebSocket-Protocol", wsProtocol) {
+			fmt.Fprintf(rw, "Sec-WebSocket-Protocol: %s\r\n", wsProtocol)
+		}
+		fmt.Fprintf(rw, "\r\n")
+		err = rw.Flush()
+		if err != nil {
+			log.Printf("websocket: %v", err)
+			nc.Close()
+			return
+		}
+
+		// The client may have sent frames along with its request, which
+		// are already in the HTTP server's buffer.
+		buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+		buffered = append([]byte(nil), buffered...)
+		c := newConn(s, nc, func(r io.Reader, w io.Writer, max uint64) transport {
+			return newWSTransport(io.MultiReader(bytes.NewReader(buffered), r), w, max)
+		})
+		go c.run()
+	})
+}
+
+// Checks that r is a valid WebSocket opening handshake and returns its key.
+func checkUpgrade(r *http.Request) (string, error) {
+	if r.Method != http.MethodGet {
+		return "", errors.New("WebSocket upgrade requires GET")
+	}
+	if !hasToken(r.Header, "Connection", "upgrade") || !hasToken(r.Header, "Upgrade", "websocket") {
+		return "", errors.New("Expected a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return "", errors.New("Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	nonce, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(nonce) != 16 {
+		return "", errors.New("Bad Sec-WebSocket-Key")
+	}
+	return key, nil
+}
+
+// Reports whether the comma-separated header name contains token, ignoring
+// case.
+func hasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A wsTransport sends frames as binary WebSocket messages. The reader answers
+// pings and close frames itself, so writes are serialized by a lock.
+type wsTransport struct {
+	r   *bufio.Reader
+	max uint64
+
+	wmu    sync.Mutex
+	w      io.Writer
+	buf    []byte
+	closed bool
+}
+
+func newWSTransport(r io.Reader, w io.Writer, max uint64) transport {
+	return &wsTransport{r: bufio.NewReader(r), w: w, max: max}
+}
+
+// Reads the next binary message, answering control frames which arrive
+// before or within it.
+func (t *wsTransport) ReadFrame() ([]byte, error) {
+	var (
+		msg     []byte
+		started bool
+	)
+	for {
+		fin, opcode, payload, err := t.readFrame(uint64(len(msg)), started)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			err = t.writeFrame(wsPong, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			// Echo the client's status code and end the stream.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			t.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		case wsBinary:
+			if started {
+				return nil, t.fail("Expected continuation frame")
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, t.fail("Unexpected continuation frame")
+			}
+		case wsText:
+			return nil, t.fail("Text messages are not supported")
+		default:
+			return nil, t.fail(fmt.Sprintf("Unknown opcode %d", opcode))
+		}
+
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// Reads and unmasks a single WebSocket frame. read is the size of the message
+// read so far, which counts towards the maximum size. At a clean end of
+// stream outside a message, io.EOF is returned.
+func (t *wsTransport) readFrame(read uint64, started bool) (bool, byte, []byte, error) {
+	var head [2]byte
+	_, err := io.ReadFull(t.r, head[:])
+	if err == io.EOF && !started {
+		return false, 0, nil, io.EOF
+	} else if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, 0, nil, &frame.TruncatedError{}
+	} else if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, t.fail("Reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, t.fail("Client frames must be masked")
+	}
+
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(t.r, ext[:])
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(t.r, ext[:])
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return false, 0, nil, t.truncated(err, 0, 0)
+	}
+
+	control := opcode&0x8 != 0
+	if control && (!fin || size > 125) {
+		return false, 0, nil, t.fail("Bad control frame")
+	}
+	if !control && size > t.max-read {
+		return false, 0, nil, &frame.TooLargeError{Size: read + size, Max: t.max}
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(t.r, mask[:])
+	if err != nil {
+		return false, 0, nil, t.truncated(err, 0, 0)
+	}
+	payload := make([]byte, size)
+	n, err := io.ReadFull(t.r, payload)
+	if err != nil {
+		return false, 0, nil, t.truncated(err, size, uint64(n))
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (t *wsTransport) truncated(err error, size, read uint64) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &frame.TruncatedError{Size: size, Read: read}
+	}
+	return err
+}
+
+// Closes the WebSocket with a protocol error status and returns the error.
+func (t *wsTransport) fail(message string) error {
+	var status [2]byte
+	binary.BigEndian.PutUint16(status[:], wsStatusProtocol)
+	t.writeFrame(wsClose, status[:])
+	return &wsError{message}
+}
+
+// Writes body as a single binary message.
+func (t *wsTransport) WriteFrame(body []byte) error {
+	if uint64(len(body)) > t.max {
+		return &frame.TooLargeError{Size: uint64(len(body)), Max: t.max}
+	}
+	return t.writeFrame(wsBinary, body)
+}
+
+func (t *wsTransport) closeWrite() error {
+	var status [2]byte
+	binary.BigEndian.PutUint16(status[:], wsStatusNormal)
+	return t.writeFrame(wsClose, status[:])
+}
+
+// Writes a single unmasked frame with the FIN bit set. Nothing is written
+// after a close frame.
+func (t *wsTransport) writeFrame(opcode byte, payload []byte) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+
+	if t.closed {
+		return errors.New("WebSocket already closed")
+	}
+	if opcode == wsClose {
+		t.closed = true
+	}
+
+	var head [10]byte
+	head[0] = 0x80 | opcode
+	n := 2
+	switch size := len(payload); {
+	case size < 126:
+		head[1] = byte(size)
+	case size <= 0xffff:
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(size))
+		n += 2
+	default:
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(size))
+		n += 8
+	}
+	t.buf = append(t.buf[:0], head[:n]...)
+	t.buf = append(t.buf, payload...)
+	_, err := t.w.Write(t.buf)
+	return err
+}
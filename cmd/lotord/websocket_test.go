@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"lotor/proto"
+)
+
+// Starts the WebSocket server of a harness on a loopback TCP listener and
+// returns its address.
+func (h *harness) listenWebSocket() string {
+	h.t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	go h.srv.websocketServer().Serve(l)
+	h.t.Cleanup(func() {
+		l.Close()
+	})
+	return l.Addr().String()
+}
+
+// A wsClient speaks WebSocket frames directly, so that tests can send frames
+// the server must reject.
+type wsClient struct {
+	t  *testing.T
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// Sends an upgrade request from a page of the given origin, if any, followed
+// by early, and returns the response along with the client.
+func dialWebSocket(t *testing.T, addr, origin string, early []byte) (*wsClient, *http.Response) {
+	t.Helper()
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		nc.Close()
+	})
+	nc.SetDeadline(time.Now().Add(recvTimeout))
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "GET / HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n", addr)
+	if origin != "" {
+		fmt.Fprintf(&req, "Origin: %s\r\n", origin)
+	}
+	req.WriteString("\r\n")
+	req.Write(early)
+	_, err = nc.Write(req.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &wsClient{t: t, nc: nc, r: bufio.NewReader(nc)}
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, resp
+}
+
+// Upgrades to a WebSocket, failing the test if the server refuses.
+func upgradeWebSocket(t *testing.T, addr string, early []byte) *wsClient {
+	t.Helper()
+
+	c, resp := dialWebSocket(t, addr, "", early)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %s", resp.Status)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad Sec-WebSocket-Accept %q", accept)
+	}
+	return c
+}
+
+// Encodes a client frame, masked unless unmasked is set.
+func wsFrame(fin bool, opcode byte, payload []byte, unmasked bool) []byte {
+	var b []byte
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	b = append(b, head)
+
+	var maskBit byte = 0x80
+	if unmasked {
+		maskBit = 0
+	}
+	var ext [8]byte
+	switch size := len(payload); {
+	case size < 126:
+		b = append(b, maskBit|byte(size))
+	case size <= 0xffff:
+		binary.BigEndian.PutUint16(ext[:], uint16(size))
+		b = append(append(b, maskBit|126), ext[:2]...)
+	default:
+		binary.BigEndian.PutUint64(ext[:], uint64(size))
+		b = append(append(b, maskBit|127), ext[:]...)
+	}
+	if unmasked {
+		return append(b, payload...)
+	}
+
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask[:]...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+func (c *wsClient) write(frames ...[]byte) {
+	c.t.Helper()
+
+	_, err := c.nc.Write(bytes.Join(frames, nil))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Reads a single server frame, which must have the FIN bit set and must not
+// be masked.
+func (c *wsClient) read() (byte, []byte) {
+	c.t.Helper()
+
+	var head [2]byte
+	_, err := io.ReadFull(c.r, head[:])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		c.t.Fatalf("bad frame header %x", head)
+	}
+
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.r, ext[:])
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.r, ext[:])
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+// Reads a binary message and decodes the Msg it carries.
+func (c *wsClient) readMsg() proto.Msg {
+	c.t.Helper()
+
+	opcode, payload := c.read()
+	if opcode != wsBinary {
+		c.t.Fatalf("expected a binary frame, got opcode %d", opcode)
+	}
+	var msg proto.Msg
+	err := proto.DecodeMsg(payload, &msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// Expects a close frame with the given status, followed by the end of the
+// connection.
+func (c *wsClient) expectClose(status uint16) {
+	c.t.Helper()
+
+	opcode, payload := c.read()
+	if opcode != wsClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != status {
+		c.t.Fatalf("expected close frame with status %d, got opcode %d with %x", status, opcode, payload)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		c.t.Fatal("expected the connection to be closed")
+	}
+}
+
+func encodeMsg(t *testing.T, msg proto.Msg) []byte {
+	t.Helper()
+
+	data, err := proto.EncodeMsg(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// A MsgHello split across two fragments with a ping between them, the first
+// of which is sent along with the upgrade request, is answered with a pong
+// and then a MsgHello. A target long enough to need an extended length then
+// goes through in both directions.
+func TestWebSocketFragmented(t *testing.T) {
+	h := newHarness(t)
+	addr := h.listenWebSocket()
+
+	hello := encodeMsg(t, &proto.MsgHello{Version: proto.Version})
+	c := upgradeWebSocket(t, addr, wsFrame(false, wsBinary, hello[:1], false))
+	c.write(
+		wsFrame(true, wsPing, []byte("are you there"), false),
+		wsFrame(true, wsContinuation, hello[1:], false),
+	)
+	if opcode, payload := c.read(); opcode != wsPong || string(payload) != "are you there" {
+		t.Fatalf("expected pong, got opcode %d with %q", opcode, payload)
+	}
+	if _, ok := c.readMsg().(*proto.MsgHello); !ok {
+		t.Fatal("expected MsgHello")
+	}
+
+	target := strings.Repeat("x", 300)
+	c.write(wsFrame(true, wsBinary, encodeMsg(t, &proto.MsgJoin{Target: []byte(target)}), false))
+	if joined, ok := c.readMsg().(*proto.MsgJoined); !ok || string(joined.Target) != target {
+		t.Fatal("expected MsgJoined")
+	}
+}
+
+func TestWebSocketRejectsFrames(t *testing.T) {
+	h := newHarness(t)
+	addr := h.listenWebSocket()
+	hello := encodeMsg(t, &proto.MsgHello{Version: proto.Version})
+
+	for name, frame := range map[string][]byte{
+		"unmasked":     wsFrame(true, wsBinary, hello, true),
+		"text":         wsFrame(true, wsText, []byte("hello"), false),
+		"continuation": wsFrame(true, wsContinuation, hello, false),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := upgradeWebSocket(t, addr, nil)
+			c.write(frame)
+			c.expectClose(wsStatusProtocol)
+		})
+	}
+}
+
+// Messages are limited in size across all their fragments.
+func TestWebSocketTooLarge(t *testing.T) {
+	h := newHarness(t, func(h *harness) {
+		h.srv.maxFrame = 100
+	})
+	addr := h.listenWebSocket()
+
+	c := upgradeWebSocket(t, addr, nil)
+	c.write(
+		wsFrame(false, wsBinary, make([]byte, 60), false),
+		wsFrame(true, wsContinuation, make([]byte, 60), false),
+	)
+	if e, ok := c.readMsg().(*proto.MsgError); !ok || e.Code != proto.ERR_TOO_LARGE {
+		t.Fatal("expected ERR_TOO_LARGE")
+	}
+	c.expectClose(wsStatusNormal)
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	h := newHarness(t, func(h *harness) {
+		h.srv.wsOrigins = map[string]bool{"https://chat.example.com": true}
+	})
+	addr := h.listenWebSocket()
+
+	_, resp := dialWebSocket(t, addr, "https://evil.example.com", nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %s", resp.Status)
+	}
+	_, resp = dialWebSocket(t, addr, "https://Chat.Example.com", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %s", resp.Status)
+	}
+}
+
+// A close frame from the client is echoed with its status code, and the
+// server then closes the connection.
+func TestWebSocketClose(t *testing.T) {
+	h := newHarness(t)
+	addr := h.listenWebSocket()
+
+	c := upgradeWebSocket(t, addr, nil)
+	c.write(wsFrame(true, wsBinary, encodeMsg(t, &proto.MsgHello{Version: proto.Version}), false))
+	if _, ok := c.readMsg().(*proto.MsgHello); !ok {
+		t.Fatal("expected MsgHello")
+	}
+
+	var status [2]byte
+	binary.BigEndian.PutUint16(status[:], wsStatusNormal)
+	c.write(wsFrame(true, wsClose, append(status[:], "bye"...), false))
+	c.expectClose(wsStatusNormal)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"lotor/client"
+	"lotor/proto"
+)
+
+// Sends a single message and waits for the server to accept it.
+func send(c *client.Conn, args []string) error {
+	target, payload := []byte(args[0]), []byte(args[1])
+	ctx := context.Background()
+
+	err := join(ctx, c, target)
+	if err != nil {
+		return err
+	}
+
+	err = c.Send(target, payload)
+	if err != nil {
+		return err
+	}
+	if !c.HasCapability(proto.CapAcks) {
+		return nil
+	}
+	_, err = await(ctx, c, target, func(msg proto.Msg) bool {
+		_, ok := msg.(*proto.MsgAck)
+		return ok
+	})
+	return err
+}
+
+// Prints the messages delivered to a target until the connection ends.
+func listen(c *client.Conn, args []string) error {
+	target := []byte(args[0])
+	ctx := context.Background()
+
+	err := join(ctx, c, target)
+	if err != nil {
+		return err
+	}
+	return printAll(ctx, c, os.Stdout, nil)
+}
+
+// Sends each line of standard input to a target while printing the messages
+// delivered to it. Ends when standard input does, once the server has
+// answered every line if it acknowledges messages, so that errors about the
+// last lines are not lost. A line too long to read ends it with an error.
+func chat(c *client.Conn, args []string) error {
+	target := []byte(args[0])
+	ctx := context.Background()
+
+	err := join(ctx, c, target)
+	if err != nil {
+		return err
+	}
+
+	answered := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	done := make(chan error, 1)
+	go func() {
+		done <- printAll(ctx, c, os.Stdout, func(msg proto.Msg) {
+			switch msg.(type) {
+			case *proto.MsgAck, *proto.MsgError:
+				if t := msgTarget(msg); t == nil || bytes.Equal(t, target) {
+					select {
+					case answered <- struct{}{}:
+					case <-quit:
+					}
+				}
+			}
+		})
+	}()
+
+	// The error that ended standard input, if any, is set before lines is
+	// closed.
+	lines := make(chan []byte)
+	var inputErr error
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- append([]byte(nil), scanner.Bytes()...)
+		}
+		inputErr = scanner.Err()
+		close(lines)
+	}()
+
+	// Every line sent is answered by either a MsgAck or a MsgError, and
+	// Recv returns no other answers about the target once it is joined.
+	acks := c.HasCapability(proto.CapAcks)
+	pending := 0
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if inputErr != nil {
+					return fmt.Errorf("Failed to read standard input: %w", inputErr)
+				}
+				if pending == 0 {
+					return nil
+				}
+				lines = nil
+				continue
+			}
+			if len(line) == 0 {
+				continue
+			}
+			err = c.Send(target, line)
+			if err != nil {
+				return err
+			}
+			if acks {
+				pending++
+			}
+		case <-answered:
+			if pending > 0 {
+				pending--
+			}
+			if lines == nil && pending == 0 {
+				return nil
+			}
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+// Joins target, unless it is a user target, and waits for the server to
+// confirm it.
+func join(ctx context.Context, c *client.Conn, target []byte) error {
+	if _, ok := proto.ParseUserTarget(target); ok {
+		return nil
+	}
+
+	err := c.Join(target)
+	if err != nil {
+		return err
+	}
+	_, err = await(ctx, c, target, func(msg proto.Msg) bool {
+		_, ok := msg.(*proto.MsgJoined)
+		return ok
+	})
+	return err
+}
+
+// Receives messages until one about target satisfies match, and returns it.
+// A MsgError about target is returned as an error.
+func await(ctx context.Context, c *client.Conn, target []byte, match func(proto.Msg) bool) (proto.Msg, error) {
+	for {
+		msg, err := c.Recv(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg, ok := msg.(*proto.MsgError); ok {
+			if msg.Target == nil || bytes.Equal(*msg.Target, target) {
+				return nil, &client.Error{Code: msg.Code, Message: msg.Message}
+			}
+			continue
+		}
+		if match(msg) && bytes.Equal(msgTarget(msg), target) {
+			return msg, nil
+		}
+	}
+}
+
+// Returns the target a message is about, or nil if it is not about any.
+func msgTarget(msg proto.Msg) []byte {
+	switch msg := msg.(type) {
+	case *proto.MsgJoined:
+		return msg.Target
+	case *proto.MsgParted:
+		return msg.Target
+	case *proto.MsgDeliver:
+		return msg.Target
+	case *proto.MsgAck:
+		return msg.Target
+	case *proto.MsgError:
+		if msg.Target != nil {
+			return *msg.Target
+		}
+	}
+	return nil
+}
+
+// Prints delivered messages to w and errors to the log until the connection
+// ends, and returns the error that ended it. If seen is not nil, it is called
+// with every message once it has been printed.
+func printAll(ctx context.Context, c *client.Conn, w io.Writer, seen func(proto.Msg)) error {
+	for {
+		msg, err := c.Recv(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *proto.MsgDeliver:
+			t := time.Unix(0, msg.Time)
+			fmt.Fprintf(w, "%s <%s> %s\n", t.Format("15:04:05"), printable([]byte(msg.Sender)), printable(msg.Payload))
+		case *proto.MsgError:
+			log.Print(&client.Error{Code: msg.Code, Message: msg.Message})
+		}
+		if seen != nil {
+			seen(msg)
+		}
+	}
+}
+
+// Returns data as is if it is printable text, so that other members of a
+// target cannot send escape sequences to the terminal. Text with control
+// characters is quoted, and anything else is shown in hex like lotor-dump
+// does.
+func printable(data []byte) string {
+	if !utf8.Valid(data) {
+		return "hex:" + hex.EncodeToString(data)
+	}
+	for _, r := range string(data) {
+		if !strconv.IsPrint(r) {
+			return strconv.Quote(string(data))
+		}
+	}
+	return string(data)
+}
@@ -0,0 +1,299 @@
+// Package faultnet wraps network connections to inject faults into the
+// frames written to them: latency, partial writes, truncation, resets and
+// reordering. Every fault is decided by a random number generator seeded from
+// the configuration, so that a failing run can be reproduced by reusing its
+// seed.
+//
+// Faults are applied on the write side only, and assume that the bytes
+// written are a stream of lotor frames. Wrapping both ends of a connection
+// injects faults in both directions.
+package faultnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Returned by writes once a connection was reset by fault injection.
+var ErrReset = errors.New("Connection reset by fault injection")
+
+// Returned by writes once a frame was truncated by fault injection, which
+// also closes the connection.
+var ErrTruncated = errors.New("Frame truncated by fault injection")
+
+// How long a reordered frame is held back if no other frame follows it, when
+// the configuration does not say.
+const DefaultHoldTimeout = 10 * time.Millisecond
+
+// Config selects the faults to inject. Probabilities are per frame and range
+// from 0 to 1.
+type Config struct {
+	Seed int64
+
+	// Each frame is delayed by a random duration of up to Latency.
+	Latency time.Duration
+	// Probability that a frame is written in several pieces.
+	PartialWrite float64
+	// Probability that only part of a frame is written, after which the
+	// connection is closed.
+	Truncate float64
+	// Probability that the connection is reset instead of writing a frame.
+	Reset float64
+	// Probability that a frame is held back and written after the next
+	// one. If no frame follows within HoldTimeout, it is written anyway.
+	Reorder     float64
+	HoldTimeout time.Duration
+}
+
+// A Conn injects faults into the frames written to the connection it wraps.
+// It is safe for concurrent use.
+type Conn struct {
+	net.Conn
+	cfg Config
+
+	mu  sync.Mutex
+	rng *rand.Rand
+	// Bytes written which do not form a whole frame yet.
+	buf []byte
+	// A frame held back to be written after the next one, with the way it
+	// will be written already decided.
+	held  *write
+	timer *time.Timer
+	err   error
+}
+
+// A write is the way a frame is written to the underlying connection: after
+// a delay, and in pieces which end at the given offsets. Every random draw for
+// it is made when the frame is written to the Conn, so that the sequence of
+// draws does not depend on when a held frame is released.
+type write struct {
+	frame []byte
+	delay time.Duration
+	cuts  []int
+}
+
+// Wraps nc to inject the faults described by cfg.
+func Wrap(nc net.Conn, cfg Config) *Conn {
+	if cfg.HoldTimeout == 0 {
+		cfg.HoldTimeout = DefaultHoldTimeout
+	}
+	return &Conn{
+		Conn: nc,
+		cfg:  cfg,
+		rng:  rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+// Dials addr and wraps the connection to inject the faults described by cfg.
+// The result can be passed to client.NewConn.
+func Dial(network, addr string, cfg Config) (*Conn, error) {
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(nc, cfg), nil
+}
+
+// Buffers p and writes every frame it completes, injecting faults. Once a
+// fault has broken the connection, every write fails. If it fails, the bytes
+// of p counted as written are those of the frames written before the failure.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	// Bytes of the buffer which came from earlier writes, and bytes of the
+	// buffer consumed by the frames written so far.
+	earlier := len(c.buf)
+	consumed := 0
+	c.buf = append(c.buf, p...)
+	for {
+		n := frameLen(c.buf)
+		if n == 0 {
+			break
+		}
+		f := make([]byte, n)
+		copy(f, c.buf)
+		c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+
+		err := c.writeFrame(f)
+		if err != nil {
+			written := consumed - earlier
+			if written < 0 {
+				written = 0
+			}
+			return written, err
+		}
+		consumed += n
+	}
+	return len(p), nil
+}
+
+// Returns the size of the first frame in buf, including its length prefix,
+// or 0 if buf does not hold a whole frame. A prefix which is not a valid
+// uvarint makes the whole buffer count as one frame.
+func frameLen(buf []byte) int {
+	size, n := binary.Uvarint(buf)
+	if n == 0 {
+		return 0
+	} else if n < 0 {
+		return len(buf)
+	}
+	if uint64(len(buf)-n) < size {
+		return 0
+	}
+	return n + int(size)
+}
+
+// Must be called with c.mu held.
+func (c *Conn) writeFrame(f []byte) error {
+	switch r := c.rng.Float64(); {
+	case r < c.cfg.Reset:
+		return c.fail(ErrReset)
+	case r < c.cfg.Reset+c.cfg.Truncate:
+		if len(f) > 1 {
+			c.do(c.plan(f[:1+c.rng.Intn(len(f)-1)]))
+		}
+		return c.fail(ErrTruncated)
+	}
+
+	// Both draws are made for every frame, even if another frame is held
+	// already, since whether it still is depends on timing.
+	hold := c.rng.Float64() < c.cfg.Reorder
+	w := c.plan(f)
+	if hold && c.held == nil {
+		c.held = w
+		c.timer = time.AfterFunc(c.cfg.HoldTimeout, c.release)
+		return nil
+	}
+
+	err := c.do(w)
+	if err != nil {
+		return err
+	}
+	if c.held != nil {
+		held := c.held
+		c.held = nil
+		c.timer.Stop()
+		return c.do(held)
+	}
+	return nil
+}
+
+// Writes the frame held back, if it is still there. Whether a held frame is
+// released by the next frame or by this timeout depends on timing, but either
+// way no random values are drawn here.
+func (c *Conn) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.held != nil && c.err == nil {
+		held := c.held
+		c.held = nil
+		c.do(held)
+	}
+}
+
+// Decides how to write f: after a random delay, and possibly in several
+// pieces. Must be called with c.mu held.
+func (c *Conn) plan(f []byte) *write {
+	w := &write{frame: f}
+	if c.cfg.Latency > 0 {
+		w.delay = time.Duration(c.rng.Int63n(int64(c.cfg.Latency)))
+	}
+
+	pieces := 1
+	if len(f) > 1 && c.rng.Float64() < c.cfg.PartialWrite {
+		pieces = 2 + c.rng.Intn(len(f)-1)
+		if pieces > len(f) {
+			pieces = len(f)
+		}
+	}
+	end := 0
+	for ; pieces > 1; pieces-- {
+		end += 1 + c.rng.Intn(len(f)-end-pieces+1)
+		w.cuts = append(w.cuts, end)
+	}
+	w.cuts = append(w.cuts, len(f))
+	return w
+}
+
+// Carries out w on the underlying connection. Must be called with c.mu held.
+func (c *Conn) do(w *write) error {
+	time.Sleep(w.delay)
+
+	start := 0
+	for _, end := range w.cuts {
+		_, err := c.Conn.Write(w.frame[start:end])
+		if err != nil {
+			c.err = err
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// Breaks the connection with err. TCP connections are reset rather than
+// closed cleanly. Must be called with c.mu held.
+func (c *Conn) fail(err error) error {
+	c.err = err
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Conn.Close()
+	return err
+}
+
+// Writes the frame held back, if any, and closes the connection.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.held != nil && c.err == nil {
+		c.timer.Stop()
+		c.do(c.held)
+		c.held = nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// A Listener wraps every connection it accepts to inject faults. The nth
+// connection accepted, counting from zero, uses the seed of the
+// configuration plus n.
+type Listener struct {
+	net.Listener
+	cfg Config
+
+	mu sync.Mutex
+	n  int64
+}
+
+// Wraps l to inject the faults described by cfg into every connection it
+// accepts. The result can be served by lotord.
+func WrapListener(l net.Listener, cfg Config) *Listener {
+	return &Listener{Listener: l, cfg: cfg}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	cfg := l.cfg
+	cfg.Seed += l.n
+	l.n++
+	l.mu.Unlock()
+	return Wrap(nc, cfg), nil
+}
@@ -0,0 +1,176 @@
+package faultnet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"lotor/frame"
+)
+
+// Writes n frames, "0" to "n-1", through a Conn wrapping one end of a pipe
+// and returns the bodies read from the other end until it fails, and the
+// error it failed with.
+func exchange(t *testing.T, cfg Config, n int) ([]string, error) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	c := Wrap(client, cfg)
+	go func() {
+		w := frame.NewWriter(c, frame.DefaultMaxSize)
+		for i := 0; i < n; i++ {
+			if w.WriteFrame([]byte(fmt.Sprint(i))) != nil {
+				return
+			}
+		}
+		c.Close()
+	}()
+
+	r := frame.NewReader(server, frame.DefaultMaxSize)
+	var got []string
+	for {
+		body, err := r.ReadFrame()
+		if err != nil {
+			server.Close()
+			return got, err
+		}
+		got = append(got, string(body))
+	}
+}
+
+func TestPartialWrites(t *testing.T) {
+	got, err := exchange(t, Config{Seed: 1, PartialWrite: 1, Latency: time.Millisecond}, 10)
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	want := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	got, _ := exchange(t, Config{Seed: 1, Reorder: 1, HoldTimeout: time.Minute}, 4)
+	want := []string{"1", "0", "3", "2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	_, err := exchange(t, Config{Seed: 1, Truncate: 1}, 1)
+	var truncated *frame.TruncatedError
+	if !errors.As(err, &truncated) {
+		t.Fatalf("expected a truncated frame, got %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	c := Wrap(client, Config{Seed: 1, Reset: 1})
+
+	_, err := c.Write([]byte{1, 'x'})
+	if err != ErrReset {
+		t.Fatalf("expected ErrReset, got %v", err)
+	}
+	_, err = server.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestSeedReproducible(t *testing.T) {
+	cfg := Config{Seed: 42, Reorder: 0.3, Reset: 0.02, Truncate: 0.02, HoldTimeout: time.Minute}
+	first, firstErr := exchange(t, cfg, 200)
+	second, secondErr := exchange(t, cfg, 200)
+	if !reflect.DeepEqual(first, second) || fmt.Sprint(firstErr) != fmt.Sprint(secondErr) {
+		t.Fatalf("runs with the same seed differ:\n%q %v\n%q %v", first, firstErr, second, secondErr)
+	}
+}
+
+// Returns the sizes of the writes on the underlying connection which carried
+// each frame written through a Conn with cfg, by frame. The frames are written
+// pace apart.
+func chunking(t *testing.T, cfg Config, n int, pace time.Duration) map[string][]int {
+	t.Helper()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	c := Wrap(client, cfg)
+	go func() {
+		w := frame.NewWriter(c, frame.DefaultMaxSize)
+		for i := 0; i < n; i++ {
+			if w.WriteFrame([]byte(fmt.Sprint(i))) != nil {
+				return
+			}
+			time.Sleep(pace)
+		}
+		c.Close()
+	}()
+
+	// The pieces of a frame are written one after the other, and a pipe
+	// returns each write in a read of its own.
+	chunks := make(map[string][]int)
+	var (
+		pending []byte
+		sizes   []int
+	)
+	buf := make([]byte, 1024)
+	for {
+		k, err := server.Read(buf)
+		if err != nil {
+			return chunks
+		}
+		pending = append(pending, buf[:k]...)
+		sizes = append(sizes, k)
+		if frameLen(pending) == len(pending) {
+			chunks[string(pending)] = sizes
+			pending, sizes = nil, nil
+		}
+	}
+}
+
+// Whether held frames are released by their timeout or by the next frame
+// must not change how frames are written.
+func TestSeedReproducibleWithTimeouts(t *testing.T) {
+	cfg := Config{
+		Seed:         42,
+		Latency:      100 * time.Microsecond,
+		PartialWrite: 0.5,
+		Reorder:      0.3,
+		HoldTimeout:  time.Millisecond,
+	}
+	timeouts := chunking(t, cfg, 50, 5*time.Millisecond)
+	cfg.HoldTimeout = time.Minute
+	next := chunking(t, cfg, 50, 0)
+	if len(timeouts) != 50 || !reflect.DeepEqual(timeouts, next) {
+		t.Fatalf("runs with the same seed differ:\n%v\n%v", timeouts, next)
+	}
+}
+
+// A write failing on its second frame reports the first one as written.
+func TestWriteCount(t *testing.T) {
+	frames := []byte{1, 'a', 1, 'b'}
+	for seed := int64(0); seed < 100; seed++ {
+		server, client := net.Pipe()
+		go io.Copy(io.Discard, server)
+		n, err := Wrap(client, Config{Seed: seed, Reset: 0.5}).Write(frames)
+		server.Close()
+		switch {
+		case err == nil:
+			if n != len(frames) {
+				t.Fatalf("seed %d: wrote %d bytes without an error", seed, n)
+			}
+		case n == 2:
+			return
+		case n != 0:
+			t.Fatalf("seed %d: expected 0 or 2 bytes written, got %d", seed, n)
+		}
+	}
+	t.Fatal("no seed reset the connection on the second frame")
+}
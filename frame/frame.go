@@ -0,0 +1,154 @@
+// Package frame implements the length-prefixed framing used to carry BARE
+// messages over byte streams. Each frame is a uvarint length followed by that
+// many bytes of body.
+package frame
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// DefaultMaxSize is the maximum frame body size used when a connection does
+// not configure its own.
+const DefaultMaxSize uint64 = 1024 * 1024 /* 1 MiB */
+
+// Returned when a frame's length prefix announces a body larger than the
+// configured maximum, or when writing such a body is attempted. A length
+// prefix which does not fit in 64 bits is reported with the largest Size.
+type TooLargeError struct {
+	Size uint64
+	Max  uint64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("Frame size %d exceeds configured limit of %d", e.Size, e.Max)
+}
+
+// Returned when the stream ends in the middle of a frame. Size is the body
+// size announced by the length prefix, or zero if the prefix itself was cut
+// short; Read is the number of body bytes received before the end.
+type TruncatedError struct {
+	Size uint64
+	Read uint64
+}
+
+func (e *TruncatedError) Error() string {
+	if e.Size == 0 {
+		return "Frame truncated in length prefix"
+	}
+	return fmt.Sprintf("Frame truncated after %d of %d bytes", e.Read, e.Size)
+}
+
+// A ReadFramer reads whole frames, such as a Reader or a transport which
+// carries each frame body in a message of its own.
+type ReadFramer interface {
+	// Returns the body of the next frame, or io.EOF at a clean end of
+	// stream.
+	ReadFrame() ([]byte, error)
+}
+
+// A WriteFramer writes whole frames, such as a Writer or a transport which
+// carries each frame body in a message of its own.
+type WriteFramer interface {
+	WriteFrame(body []byte) error
+}
+
+// A Reader reads frames from a byte stream. It is not safe for concurrent use.
+type Reader struct {
+	base *bufio.Reader
+	max  uint64
+}
+
+// Returns a new Reader reading frames of at most max bytes from r.
+func NewReader(r io.Reader, max uint64) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{base: br, max: max}
+}
+
+// Reads the next frame and returns its body. At a clean end of stream between
+// frames, io.EOF is returned.
+func (r *Reader) ReadFrame() ([]byte, error) {
+	size, err := r.readSize()
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, &TruncatedError{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if size > r.max {
+		return nil, &TooLargeError{Size: size, Max: r.max}
+	}
+
+	body := make([]byte, size)
+	n, err := io.ReadFull(r.base, body)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, &TruncatedError{Size: size, Read: uint64(n)}
+	} else if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// Reads a length prefix like binary.ReadUvarint, except that one which does
+// not fit in 64 bits is reported as a TooLargeError.
+func (r *Reader) readSize() (uint64, error) {
+	var (
+		size  uint64
+		shift uint
+	)
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		b, err := r.base.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				break
+			}
+			return size | uint64(b)<<shift, nil
+		}
+		size |= uint64(b&0x7f) << shift
+		shift += 7
+	}
+	return 0, &TooLargeError{Size: math.MaxUint64, Max: r.max}
+}
+
+// A Writer writes frames to a byte stream. It is not safe for concurrent use.
+type Writer struct {
+	base    io.Writer
+	max     uint64
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+// Returns a new Writer writing frames of at most max bytes to w.
+func NewWriter(w io.Writer, max uint64) *Writer {
+	return &Writer{base: w, max: max}
+}
+
+// Writes body as a single frame. The length prefix and body are handed to the
+// underlying writer in one Write call.
+func (w *Writer) WriteFrame(body []byte) error {
+	size := uint64(len(body))
+	if size > w.max {
+		return &TooLargeError{Size: size, Max: w.max}
+	}
+
+	n := binary.PutUvarint(w.scratch[:], size)
+	w.buf = append(w.buf[:0], w.scratch[:n]...)
+	w.buf = append(w.buf, body...)
+	_, err := w.base.Write(w.buf)
+	return err
+}
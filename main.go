@@ -1,27 +1,109 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
 	"os"
+
+	"lotor/capture"
+	"lotor/client"
 )
 
+const usage = `usage: lotor [flags] command [arguments]
+
+Commands:
+  send TARGET PAYLOAD  send PAYLOAD to TARGET and wait for the server to accept it
+  listen TARGET        join TARGET and print the messages delivered to it
+  chat TARGET          join TARGET, print its messages and send each line read
+                       from standard input
+
+Environment:
+  LOTOR_PASSWORD       password to log in as -user with
+  LOTOR_TOKEN          bearer token to log in with, if LOTOR_PASSWORD is not set
+
+Flags:
+`
+
 func main() {
-	// Temporary sender since we don't have networking code yet
-	writer := bufio.NewWriter(os.Stdout)
-	send := func(data []byte) error {
-		_, err := writer.Write(data)
+	log.SetFlags(0)
+	log.SetPrefix("lotor: ")
+
+	addr := flag.String("addr", "localhost:7070", "address of the lotord server")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	user := flag.String("user", "", "identity to log in as with the password in LOTOR_PASSWORD")
+	record := flag.String("capture", "", "record the connection into this capture file")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var opts []client.Option
+	if *useTLS {
+		opts = append(opts, client.WithTLS(&tls.Config{}))
+	}
+	// Credentials are not taken as flags, where other local users could
+	// see them.
+	if password := os.Getenv("LOTOR_PASSWORD"); password != "" {
+		if *user == "" {
+			log.Fatal("LOTOR_PASSWORD requires -user")
+		}
+		opts = append(opts, client.WithPassword(*user, password))
+	} else if token := os.Getenv("LOTOR_TOKEN"); token != "" {
+		opts = append(opts, client.WithToken(token))
+	}
+
+	var cmd func(c *client.Conn, args []string) error
+	switch args[0] {
+	case "send":
+		if len(args) != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		cmd = send
+	case "listen":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		cmd = listen
+	case "chat":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		cmd = chat
+	default:
+		log.Printf("unknown command %q", args[0])
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *record != "" {
+		cw, err := capture.Create(*record, capture.CLIENT)
 		if err != nil {
-			return err
+			log.Fatal(err)
 		}
-		err = writer.Flush()
-		return err
+		defer cw.Close()
+		opts = append(opts, client.WithCapture(cw))
 	}
 
-	msg := MsgJoin{
-		Target: []byte("target"),
+	c, err := client.Dial(*addr, opts...)
+	if err != nil {
+		log.Fatal(err)
 	}
-	err := encodeSend(send, msg)
+	defer c.Close()
+
+	err = cmd(c, args[1:])
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 }
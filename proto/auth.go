@@ -0,0 +1,12 @@
+package proto
+
+// Prefixed to the challenge nonce before signing, so that a signature made
+// for lotor authentication cannot be reused for anything else.
+const challengeContext = "lotor ed25519 challenge\x00"
+
+// Returns the message signed in MsgAuthSignature in answer to nonce.
+func ChallengeMessage(nonce []byte) []byte {
+	msg := make([]byte, 0, len(challengeContext)+len(nonce))
+	msg = append(msg, challengeContext...)
+	return append(msg, nonce...)
+}
@@ -0,0 +1,50 @@
+package proto
+
+// The protocol version spoken by this package, and the oldest version it can
+// still interoperate with. Both are exchanged in MsgHello.
+const (
+	Version    uint = 3
+	MinVersion uint = 2
+)
+
+// The first version in which MsgPing and MsgPong may be sent. Peers speaking
+// an older version cannot decode them.
+const PingVersion uint = 3
+
+// Capability names exchanged in MsgHello.
+const (
+	// The server acknowledges each accepted MsgMsg with MsgAck.
+	CapAcks = "acks"
+	// The server stores messages and answers MsgHistory.
+	CapHistory = "history"
+	// The server accepts MsgAuthExternal, logging clients in with the
+	// identity established by their transport.
+	CapExternalAuth = "external-auth"
+)
+
+// Returns the version to speak with a peer that announced version peer, or
+// false if the two are incompatible.
+func NegotiateVersion(peer uint) (uint, bool) {
+	if peer < MinVersion {
+		return 0, false
+	}
+	if peer < Version {
+		return peer, true
+	}
+	return Version, true
+}
+
+// Returns the capabilities in offered which also appear in supported, in the
+// order they were offered.
+func NegotiateCapabilities(offered, supported []string) []string {
+	var caps []string
+	for _, cap := range offered {
+		for _, s := range supported {
+			if cap == s {
+				caps = append(caps, cap)
+				break
+			}
+		}
+	}
+	return caps
+}
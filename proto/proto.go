@@ -0,0 +1,91 @@
+// Package proto holds the lotor protocol: the Msg union and its members, which
+// are generated from schema.bare, and helpers to send and receive them over a
+// framed byte stream.
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"lotor/bareish"
+	"lotor/frame"
+)
+
+// Returned by DecodeMsg when data holds more than a single Msg.
+var ErrTrailingBytes = errors.New("Trailing bytes after message")
+
+// Decodes a single Msg from data, which must hold nothing else.
+func DecodeMsg(data []byte, val *Msg) error {
+	br := bytes.NewReader(data)
+	err := bareish.UnmarshalBareReader(bareish.NewReader(br), val)
+	if err != nil {
+		return err
+	}
+	if br.Len() > 0 {
+		return ErrTrailingBytes
+	}
+	return nil
+}
+
+// Encodes val into a BARE message.
+func EncodeMsg(val *Msg) ([]byte, error) {
+	return bareish.Marshal(val)
+}
+
+// Encodes val as a Msg and writes it to w as a single frame.
+func EncodeSend(w frame.WriteFramer, val interface{ bareish.Union }) error {
+	msg := Msg(val)
+	return EncodeMsgSend(w, &msg)
+}
+
+// Encodes val and writes it to w as a single frame.
+func EncodeMsgSend(w frame.WriteFramer, val *Msg) error {
+	data, err := EncodeMsg(val)
+	if err != nil {
+		return err
+	}
+	err = w.WriteFrame(data)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returned by DecodeRecv when a frame does not hold a valid Msg.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Malformed message: %v", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Reads frames from r until the end of the stream, decoding each into a Msg
+// and passing it to recv. A clean end of stream between frames returns nil.
+func DecodeRecv(r frame.ReadFramer, recv func(Msg) error) error {
+	for {
+		data, err := r.ReadFrame()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var msg Msg
+		err = DecodeMsg(data, &msg)
+		if err != nil {
+			return &DecodeError{err}
+		}
+
+		err = recv(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package proto
+
+// Prefix of targets which address a user by identity instead of naming a
+// target to be joined.
+const UserTargetPrefix = '@'
+
+// Returns the target addressing the user with the given identity.
+func UserTarget(identity string) []byte {
+	target := make([]byte, 0, len(identity)+1)
+	target = append(target, UserTargetPrefix)
+	return append(target, identity...)
+}
+
+// Returns the identity addressed by target, or false if target is not a user
+// target.
+func ParseUserTarget(target []byte) (string, bool) {
+	if len(target) == 0 || target[0] != UserTargetPrefix {
+		return "", false
+	}
+	return string(target[1:]), true
+}